@@ -3,16 +3,25 @@ package cmd
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/Dyastin-0/gobyte/core"
+	"github.com/Dyastin-0/gobyte/tofu"
 	"github.com/common-nighthawk/go-figure"
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli/v3"
 )
 
-const defaultDir = "gobyte/received"
+const (
+	defaultDir    = "gobyte/received"
+	peersFile     = "peers"
+	peerCacheFile = "peercache.json"
+)
 
 func New() *cli.Command {
 	return &cli.Command{
@@ -20,9 +29,13 @@ func New() *cli.Command {
 		Usage:   "a simple p2p local area network file sharing cli app",
 		Version: core.VERSION,
 		Action:  gobyteAction,
+		Flags:   []cli.Flag{profileFlag()},
 		Commands: []*cli.Command{
 			sendCommand(),
 			receiveCommand(),
+			trustCommand(),
+			identityCommand(),
+			profileCommand(),
 		},
 	}
 }
@@ -42,7 +55,7 @@ func gobyteAction(ctx context.Context, cmd *cli.Command) error {
 }
 
 func defaultFlags() []cli.Flag {
-	return []cli.Flag{
+	return append(identityFlags(),
 		&cli.StringFlag{
 			Name:    "addr",
 			Aliases: []string{"a"},
@@ -58,6 +71,103 @@ func defaultFlags() []cli.Flag {
 			Aliases: []string{"b"},
 			Value:   ":42069",
 		},
+		&cli.StringFlag{
+			Name:    "name",
+			Aliases: []string{"n"},
+			Usage:   "display name announced to other peers",
+		},
+		&cli.StringFlag{
+			Name:    "group",
+			Aliases: []string{"g"},
+			Usage:   "only see and accept peers in this group",
+		},
+		&cli.StringFlag{
+			Name:    "group-secret",
+			Usage:   "only see and accept peers that know this secret",
+			Sources: cli.EnvVars("GOBYTE_GROUP_SECRET"),
+		},
+		&cli.StringFlag{
+			Name:    "trust-policy",
+			Usage:   "tofu, ca (only peers signed by --ca-file) or ca-or-tofu",
+			Value:   string(tofu.PolicyTOFU),
+			Sources: cli.EnvVars("GOBYTE_TRUST_POLICY"),
+		},
+		&cli.StringFlag{
+			Name:    "ca-file",
+			Usage:   "PEM bundle of CAs whose peers are trusted without pairing",
+			Sources: cli.EnvVars("GOBYTE_CA_FILE"),
+		},
+		&cli.StringSliceFlag{
+			Name:    "crl-file",
+			Usage:   "revocation list of a CA in --ca-file, PEM or DER (repeatable)",
+			Sources: cli.EnvVars("GOBYTE_CRL_FILE"),
+		},
+	)
+}
+
+// trustPolicy reads --trust-policy, --ca-file and --crl-file, CA policies
+// need the bundle
+func trustPolicy(cmd *cli.Command, c *core.Client) error {
+	policy, err := tofu.ParsePolicy(cmd.String("trust-policy"))
+	if err != nil {
+		return err
+	}
+
+	if policy == tofu.PolicyTOFU {
+		return nil
+	}
+
+	path := cmd.String("ca-file")
+	if path == "" {
+		return fmt.Errorf("%w: --trust-policy %s needs --ca-file", tofu.ErrorNoCAs, policy)
+	}
+
+	cas, err := tofu.LoadCAs(path)
+	if err != nil {
+		return err
+	}
+
+	var crls []*x509.RevocationList
+	for _, path := range cmd.StringSlice("crl-file") {
+		crl, err := tofu.LoadCRL(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		crls = append(crls, crl)
+	}
+
+	c.SetTrustPolicy(policy, cas, crls)
+	return nil
+}
+
+// quota reads --max-transfer, --max-daily and --max-inbox, empty ones are
+// unlimited
+func quota(cmd *cli.Command) (core.Quota, error) {
+	var q core.Quota
+
+	for flag, limit := range map[string]*uint64{
+		"max-transfer": &q.MaxTransferBytes,
+		"max-daily":    &q.MaxPeerDailyBytes,
+		"max-inbox":    &q.MaxInboxBytes,
+	} {
+		if cmd.String(flag) == "" {
+			continue
+		}
+
+		n, err := humanize.ParseBytes(cmd.String(flag))
+		if err != nil {
+			return q, fmt.Errorf("invalid --%s: %w", flag, err)
+		}
+		*limit = n
+	}
+
+	return q, nil
+}
+
+func group(cmd *cli.Command, p *core.Profile) *core.Group {
+	return &core.Group{
+		Name:   setting(cmd, "group", p.Group),
+		Secret: cmd.String("group-secret"),
 	}
 }
 
@@ -65,17 +175,88 @@ func sendCommand() *cli.Command {
 	return &cli.Command{
 		Name:   "send",
 		Usage:  "run as a sender",
-		Flags:  defaultFlags(),
+		Flags:  sendFlags(),
 		Action: sendAction,
 	}
 }
 
+func sendFlags() []cli.Flag {
+	return append(defaultFlags(),
+		&cli.StringSliceFlag{
+			Name:  "peer",
+			Usage: "add a peer that can't be discovered, as name=host:port (repeatable)",
+		},
+		&cli.BoolFlag{
+			Name:  "code",
+			Usage: "print a one-time code and only pair with the receiver that enters it",
+		},
+		&cli.StringFlag{
+			Name:  "note",
+			Usage: "text shown to the receiver when it is asked to accept",
+		},
+	)
+}
+
 func sendAction(ctx context.Context, cmd *cli.Command) error {
+	p, err := profile(cmd)
+	if err != nil {
+		return err
+	}
+
 	addr := cmd.String("addr")
-	dir := cmd.String("dir")
+	dir := setting(cmd, "dir", p.Dir)
 	baddr := cmd.String("bAddr")
 
 	s := core.NewSenderClient(addr, baddr, dir)
+	s.SetProfile(p)
+	s.SetDisplayName(cmd.String("name"))
+	s.SetGroup(group(cmd, p))
+	if err := s.SetNote(cmd.String("note")); err != nil {
+		return err
+	}
+	s.SetPassphrase(passphrase(cmd))
+	algorithm, err := keyType(cmd)
+	if err != nil {
+		return err
+	}
+	s.SetKeyAlgorithm(algorithm)
+	if err := trustPolicy(cmd, s); err != nil {
+		return err
+	}
+
+	// Static peers come from the profile's peers file and --peer
+	peers, err := core.LoadStaticPeers(filepath.Join(p.Path(), peersFile))
+	if err != nil {
+		return err
+	}
+
+	for _, def := range cmd.StringSlice("peer") {
+		p, err := core.ParseStaticPeer(def)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, p)
+	}
+	s.AddStaticPeers(peers...)
+
+	cache, err := core.LoadPeerCache(filepath.Join(p.Path(), peerCacheFile))
+	if err != nil {
+		return err
+	}
+	s.SetPeerCache(cache)
+
+	if cmd.Bool("code") {
+		code, err := tofu.NewCode()
+		if err != nil {
+			return err
+		}
+
+		if err := s.SetCode(code); err != nil {
+			return err
+		}
+
+		fmt.Printf("Pairing code is: %s\nOn the other computer, run: gobyte receive --code %s\n\n", code, code)
+	}
 
 	return s.StartSender(ctx)
 }
@@ -84,33 +265,93 @@ func receiveCommand() *cli.Command {
 	return &cli.Command{
 		Name:   "receive",
 		Usage:  "run as a receiver",
-		Flags:  defaultFlags(),
+		Flags:  receiveFlags(),
 		Action: receiveAction,
 	}
 }
 
+func receiveFlags() []cli.Flag {
+	return append(defaultFlags(),
+		&cli.BoolFlag{
+			Name:  "dnd",
+			Usage: "announce as do-not-disturb, hiding this receiver from peer lists",
+		},
+		&cli.StringFlag{
+			Name:  "code",
+			Usage: "pair with the sender that printed this one-time code",
+		},
+		&cli.StringFlag{
+			Name:    "max-transfer",
+			Usage:   "deny transfers larger than this, like 2GB",
+			Sources: cli.EnvVars("GOBYTE_MAX_TRANSFER"),
+		},
+		&cli.StringFlag{
+			Name:    "max-daily",
+			Usage:   "deny a peer's transfers once it sent this much today",
+			Sources: cli.EnvVars("GOBYTE_MAX_DAILY"),
+		},
+		&cli.StringFlag{
+			Name:    "max-inbox",
+			Usage:   "deny transfers that would grow the receive directory past this",
+			Sources: cli.EnvVars("GOBYTE_MAX_INBOX"),
+		},
+		&cli.DurationFlag{
+			Name:    "prompt-timeout",
+			Usage:   "deny pairing and transfer prompts left unanswered this long, 0 waits forever",
+			Value:   time.Minute,
+			Sources: cli.EnvVars("GOBYTE_PROMPT_TIMEOUT"),
+		},
+	)
+}
+
 func receiveAction(ctx context.Context, cmd *cli.Command) error {
+	p, err := profile(cmd)
+	if err != nil {
+		return err
+	}
+
 	addr := cmd.String("addr")
-	dir := cmd.String("dir")
-	if dir == homeDir() {
+	dir := setting(cmd, "dir", p.Dir)
+	if !cmd.IsSet("dir") && p.Dir == "" {
 		dir = filepath.Join(dir, defaultDir)
 	}
 	baddr := cmd.String("bAddr")
 
 	r := core.NewReceiverClient(addr, baddr, dir)
+	r.SetProfile(p)
+	r.SetDisplayName(cmd.String("name"))
+	r.SetGroup(group(cmd, p))
+	r.SetPromptTimeout(cmd.Duration("prompt-timeout"))
+	q, err := quota(cmd)
+	if err != nil {
+		return err
+	}
+	r.SetQuota(q)
+	r.SetPassphrase(passphrase(cmd))
+	algorithm, err := keyType(cmd)
+	if err != nil {
+		return err
+	}
+	r.SetKeyAlgorithm(algorithm)
+	if err := trustPolicy(cmd, r); err != nil {
+		return err
+	}
+	if cmd.Bool("dnd") {
+		r.SetStatus(core.StatusDND)
+	}
+	if code := cmd.String("code"); code != "" {
+		if err := r.SetCode(code); err != nil {
+			return err
+		}
+	}
 
-	errch := make(chan error, 1)
-
-	go func() {
-		errch <- r.StartReceiver(ctx)
-	}()
-
-	select {
-	case <-ctx.Done():
+	// StartReceiver returns once the listener and broadcaster are shut down
+	err = r.StartReceiver(ctx)
+	if errors.Is(err, context.Canceled) {
 		return nil
-	case err := <-errch:
-		return err
 	}
+
+	return err
 }
 
 func homeDir() string {
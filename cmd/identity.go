@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/urfave/cli/v3"
+)
+
+func identityCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "identity",
+		Usage:  "show our certificate, its fingerprint and validity",
+		Flags:  identityFlags(),
+		Action: identityAction,
+		Commands: []*cli.Command{
+			{
+				Name:   "rotate",
+				Usage:  "replace our key, peers that trusted the old one follow automatically",
+				Action: rotateAction,
+			},
+			{
+				Name:   "passwd",
+				Usage:  "set or change the passphrase of our private key, an empty one removes it",
+				Action: passwdAction,
+			},
+			{
+				Name:      "csr",
+				Usage:     "write a certificate signing request for our key, stdout by default",
+				ArgsUsage: "[file]",
+				Action:    csrAction,
+			},
+			{
+				Name:      "import-cert",
+				Usage:     "replace our certificate with one a CA issued from our csr",
+				ArgsUsage: "<file|->",
+				Action:    importCertAction,
+			},
+		},
+	}
+}
+
+// identity loads our certificate, creating or renewing it as needed
+func identity(cmd *cli.Command) (*tofu.Tofu, error) {
+	t, err := newTofu(cmd)
+	if err != nil {
+		return nil, err
+	}
+	t.Passphrase = passphrase(cmd)
+
+	algorithm, err := keyType(cmd)
+	if err != nil {
+		return nil, err
+	}
+	t.Algorithm = algorithm
+
+	if err := t.Init(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func identityAction(ctx context.Context, cmd *cli.Command) error {
+	t, err := identity(cmd)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := t.Leaf()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", leaf.Subject.CommonName)
+	fmt.Fprintf(w, "Key:\t%s\n", tofu.KeyAlgorithm(leaf))
+	fmt.Fprintf(w, "Fingerprint:\t%s\n", tofu.Fingerprint(leaf))
+	fmt.Fprintf(w, "Issued by:\t%s\n", leaf.Issuer.CommonName)
+	fmt.Fprintf(w, "Valid from:\t%s\n", formatTime(leaf.NotBefore))
+	fmt.Fprintf(w, "Valid until:\t%s (%s)\n", formatTime(leaf.NotAfter), validity(leaf.NotAfter))
+	fmt.Fprintf(w, "Certificate:\t%s\n", filepath.Join(t.CertPath, t.ID+".crt"))
+	fmt.Fprintf(w, "Private key:\t%s\n", keyProtection(t))
+
+	return w.Flush()
+}
+
+func rotateAction(ctx context.Context, cmd *cli.Command) error {
+	t, err := identity(cmd)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := t.Leaf()
+	if err != nil {
+		return err
+	}
+
+	rotation, err := t.Rotate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rotated key %s -> %s\n", tofu.Fingerprint(leaf), rotation.New)
+	return nil
+}
+
+func csrAction(ctx context.Context, cmd *cli.Command) error {
+	t, err := identity(cmd)
+	if err != nil {
+		return err
+	}
+
+	csr, err := t.CSR()
+	if err != nil {
+		return err
+	}
+
+	if cmd.NArg() == 0 {
+		_, err := os.Stdout.Write(csr)
+		return err
+	}
+
+	return os.WriteFile(cmd.Args().Get(0), csr, 0600)
+}
+
+func importCertAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	t, err := identity(cmd)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if path := cmd.Args().Get(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if err := t.ImportCert(data); err != nil {
+		return err
+	}
+
+	leaf, err := t.Leaf()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported certificate issued by %s, valid until %s\n", leaf.Issuer.CommonName, formatTime(leaf.NotAfter))
+	return nil
+}
+
+func keyProtection(t *tofu.Tofu) string {
+	if t.Encrypted() {
+		return "encrypted"
+	}
+	return "not encrypted"
+}
+
+func passwdAction(ctx context.Context, cmd *cli.Command) error {
+	t, err := identity(cmd)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := promptPassphrase("New passphrase, empty to store the key unencrypted:")
+	if err != nil {
+		return err
+	}
+
+	if len(passphrase) > 0 {
+		again, err := promptPassphrase("New passphrase again:")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return errPassphraseMismatch
+		}
+	}
+
+	if err := t.SetPassphrase(passphrase); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key is now %s\n", keyProtection(t))
+	return nil
+}
+
+func validity(notAfter time.Time) string {
+	left := time.Until(notAfter)
+	if left <= 0 {
+		return "expired"
+	}
+
+	days := int(left.Hours() / 24)
+	if days == 0 {
+		return "expires today"
+	}
+
+	return fmt.Sprintf("expires in %d days", days)
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/charmbracelet/huh"
+	"github.com/urfave/cli/v3"
+)
+
+const passphraseEnv = "GOBYTE_PASSPHRASE"
+
+var errPassphraseMismatch = errors.New("passphrases don't match")
+
+// identityFlags let daemons unlock an encrypted key without a terminal, and
+// pick the key type of a new identity
+func identityFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "key-type",
+			Usage:   "key type of a new identity or rotated key: ecdsa-p256, ed25519 or rsa-3072",
+			Sources: cli.EnvVars("GOBYTE_KEY_TYPE"),
+		},
+		&cli.IntFlag{
+			Name:    "passphrase-fd",
+			Usage:   "read the key passphrase from this file descriptor, " + passphraseEnv + " is read too",
+			Value:   -1,
+			Sources: cli.EnvVars("GOBYTE_PASSPHRASE_FD"),
+		},
+	}
+}
+
+// keyType validates --key-type, existing keys keep their type
+func keyType(cmd *cli.Command) (string, error) {
+	if cmd.String("key-type") == "" {
+		return "", nil
+	}
+	return tofu.ParseAlgorithm(cmd.String("key-type"))
+}
+
+// passphrase reads the key passphrase from GOBYTE_PASSPHRASE, --passphrase-fd
+// or a prompt, in that order
+func passphrase(cmd *cli.Command) tofu.PassphraseFunc {
+	return func() ([]byte, error) {
+		if p, ok := os.LookupEnv(passphraseEnv); ok {
+			return []byte(p), nil
+		}
+
+		if fd := cmd.Int("passphrase-fd"); fd >= 0 {
+			file := os.NewFile(uintptr(fd), "passphrase")
+			defer file.Close()
+
+			data, err := io.ReadAll(file)
+			if err != nil {
+				return nil, err
+			}
+
+			// Only the first line, so echo and here-strings work
+			line, _, _ := bytes.Cut(data, []byte("\n"))
+			return bytes.TrimSuffix(line, []byte("\r")), nil
+		}
+
+		return promptPassphrase("Passphrase of our private key:")
+	}
+}
+
+func promptPassphrase(title string) ([]byte, error) {
+	var passphrase string
+
+	err := huh.NewInput().
+		Title(title).
+		EchoMode(huh.EchoModePassword).
+		Value(&passphrase).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(passphrase), nil
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/Dyastin-0/gobyte/core"
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/urfave/cli/v3"
+)
+
+// profileFlag is set on the root command, every subcommand sees it
+func profileFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "profile",
+		Aliases: []string{"p"},
+		Usage:   "identity to use, each has its own key, trusted peers and defaults",
+		Value:   core.DefaultProfile,
+		Sources: cli.EnvVars("GOBYTE_PROFILE"),
+	}
+}
+
+// profileSettingFlags are the flag defaults a profile stores
+func profileSettingFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "name",
+			Aliases: []string{"n"},
+			Usage:   "display name announced to other peers",
+		},
+		&cli.StringFlag{
+			Name:    "dir",
+			Aliases: []string{"d"},
+			Usage:   "where received files go and files are picked from",
+		},
+		&cli.StringFlag{
+			Name:    "group",
+			Aliases: []string{"g"},
+			Usage:   "only see and accept peers in this group",
+		},
+	}
+}
+
+func profileCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "profile",
+		Usage: "manage identities, use one with --profile",
+		Commands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list profiles",
+				Action: profileListAction,
+			},
+			{
+				Name:      "create",
+				Usage:     "create a profile, its key is created when it is first used",
+				ArgsUsage: "<name>",
+				Flags:     profileSettingFlags(),
+				Action:    profileCreateAction,
+			},
+			{
+				Name:      "set",
+				Usage:     "change the defaults of a profile, an empty value clears one",
+				ArgsUsage: "<name>",
+				Flags:     profileSettingFlags(),
+				Action:    profileSetAction,
+			},
+			{
+				Name:      "remove",
+				Usage:     "delete a profile with its key and trusted peers",
+				ArgsUsage: "<name>",
+				Action:    profileRemoveAction,
+			},
+		},
+	}
+}
+
+// profile loads the profile picked by --profile
+func profile(cmd *cli.Command) (*core.Profile, error) {
+	return core.LoadProfile(cmd.String("profile"))
+}
+
+// newTofu returns the tofu of the profile picked by --profile, not initialized
+func newTofu(cmd *cli.Command) (*tofu.Tofu, error) {
+	p, err := profile(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	t := tofu.New(p.ID())
+	t.Dir = p.Path()
+	return t, nil
+}
+
+// setting returns the flag if it was given, the profile's value otherwise
+func setting(cmd *cli.Command, flag, value string) string {
+	if cmd.IsSet(flag) || value == "" {
+		return cmd.String(flag)
+	}
+	return value
+}
+
+func applySettings(cmd *cli.Command, p *core.Profile) {
+	if cmd.IsSet("name") {
+		p.DisplayName = cmd.String("name")
+	}
+	if cmd.IsSet("dir") {
+		p.Dir = cmd.String("dir")
+		if p.Dir != "" {
+			// Relative to where the profile was set, not where it is used
+			if abs, err := filepath.Abs(p.Dir); err == nil {
+				p.Dir = abs
+			}
+		}
+	}
+	if cmd.IsSet("group") {
+		p.Group = cmd.String("group")
+	}
+}
+
+func profileListAction(ctx context.Context, cmd *cli.Command) error {
+	names, err := core.Profiles()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tID\tNAME\tDIR\tGROUP")
+	for _, name := range names {
+		p, err := core.LoadProfile(name)
+		if err != nil {
+			return err
+		}
+
+		current := ""
+		if name == cmd.String("profile") {
+			current = " *"
+		}
+
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\n", p.Name, current, p.ID(), p.DisplayName, p.Dir, p.Group)
+	}
+
+	return w.Flush()
+}
+
+func profileCreateAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	p := &core.Profile{Name: cmd.Args().First()}
+	applySettings(cmd, p)
+
+	if err := core.CreateProfile(p); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created profile %s, use it with --profile %s\n", p.Name, p.Name)
+	return nil
+}
+
+func profileSetAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	p, err := core.LoadProfile(cmd.Args().First())
+	if err != nil {
+		return err
+	}
+
+	applySettings(cmd, p)
+	return p.Save()
+}
+
+func profileRemoveAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	name := cmd.Args().First()
+	if name == core.DefaultProfile {
+		return cli.Exit("the default profile can't be removed", 1)
+	}
+
+	if err := core.RemoveProfile(name); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed profile %s\n", name)
+	return nil
+}
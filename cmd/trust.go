@@ -0,0 +1,459 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli/v3"
+)
+
+func trustCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "trust",
+		Usage: "manage trusted peers",
+		Commands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "list trusted peers",
+				Action: trustListAction,
+			},
+			{
+				Name:      "show",
+				Usage:     "show a trusted peer",
+				ArgsUsage: "<id>",
+				Action:    trustShowAction,
+			},
+			{
+				Name:      "remove",
+				Usage:     "stop trusting a peer",
+				ArgsUsage: "<id>",
+				Action:    trustRemoveAction,
+			},
+			{
+				Name:      "rename",
+				Usage:     "set the display name of a trusted peer",
+				ArgsUsage: "<id> <name>",
+				Action:    trustRenameAction,
+			},
+			{
+				Name:      "note",
+				Usage:     "attach a note to a trusted peer, an empty note clears it",
+				ArgsUsage: "<id> <note>",
+				Action:    trustNoteAction,
+			},
+			{
+				Name:      "add",
+				Usage:     "pin a peer's fingerprint before it connects",
+				ArgsUsage: "<id> <fingerprint>",
+				Action:    trustAddAction,
+			},
+			{
+				Name:      "replace",
+				Usage:     "re-pin a trusted peer whose key changed",
+				ArgsUsage: "<id> <fingerprint>",
+				Action:    trustReplaceAction,
+			},
+			{
+				Name:      "allow",
+				Usage:     "set what a trusted peer may send, without flags it is asked about every transfer",
+				ArgsUsage: "<id>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "auto-accept",
+						Usage: "accept transfers within the limits below without asking",
+					},
+					&cli.StringFlag{
+						Name:  "max-bytes",
+						Usage: "largest transfer, like 500MB",
+					},
+					&cli.StringSliceFlag{
+						Name:  "type",
+						Usage: "allowed file extension, like .jpg (repeatable)",
+					},
+					&cli.StringFlag{
+						Name:  "subdir",
+						Usage: "directory under the destination the peer's files go to",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dir",
+						Usage: "directory under --subdir the peer may write into (repeatable)",
+					},
+				},
+				Action: trustAllowAction,
+			},
+			{
+				Name:      "block",
+				Usage:     "refuse a peer by ID or fingerprint and stop trusting it",
+				ArgsUsage: "<id|fingerprint> [reason]",
+				Action:    trustBlockAction,
+			},
+			{
+				Name:      "unblock",
+				Usage:     "lift a block, the peer has to pair again",
+				ArgsUsage: "<id|fingerprint>",
+				Action:    trustUnblockAction,
+			},
+			{
+				Name:   "blocked",
+				Usage:  "list blocked peers",
+				Action: trustBlockedAction,
+			},
+			{
+				Name:      "export",
+				Usage:     "write trusted peers as JSON to a file, or stdout",
+				ArgsUsage: "[file]",
+				Action:    trustExportAction,
+			},
+			{
+				Name:      "import",
+				Usage:     "add trusted peers from an export, - reads stdin",
+				ArgsUsage: "<file>",
+				Action:    trustImportAction,
+			},
+		},
+	}
+}
+
+func trustStore(cmd *cli.Command) (*tofu.Tofu, error) {
+	t, err := newTofu(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.InitTrust(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func requireArgs(cmd *cli.Command, n int) error {
+	if cmd.NArg() != n {
+		return cli.Exit(fmt.Sprintf("usage: %s %s", cmd.FullName(), cmd.ArgsUsage), 1)
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func trustListAction(ctx context.Context, cmd *cli.Command) error {
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	entries, err := t.Entries()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tFINGERPRINT\tFIRST SEEN\tLAST SEEN\tFLAGS")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.ID,
+			orDash(e.Name),
+			e.Fingerprint,
+			formatTime(e.FirstSeen),
+			formatTime(e.LastSeen),
+			orDash(strings.Join(e.Flags, ",")),
+		)
+	}
+
+	return w.Flush()
+}
+
+func trustShowAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	e, err := t.Entry(cmd.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", e.ID)
+	fmt.Fprintf(w, "Name:\t%s\n", orDash(e.Name))
+	fmt.Fprintf(w, "Key:\t%s\n", orDash(e.Algorithm))
+	fmt.Fprintf(w, "Fingerprint:\t%s\n", e.Fingerprint)
+	fmt.Fprintf(w, "First seen:\t%s\n", formatTime(e.FirstSeen))
+	fmt.Fprintf(w, "Last seen:\t%s\n", formatTime(e.LastSeen))
+	fmt.Fprintf(w, "Last address:\t%s\n", orDash(e.LastAddr))
+	fmt.Fprintf(w, "Flags:\t%s\n", orDash(strings.Join(e.Flags, ",")))
+	fmt.Fprintf(w, "Note:\t%s\n", orDash(e.Note))
+	if p := e.Permissions; p != nil {
+		fmt.Fprintf(w, "Auto accept:\t%t\n", p.AutoAccept)
+		fmt.Fprintf(w, "Max bytes:\t%s\n", maxBytes(p.MaxBytes))
+		fmt.Fprintf(w, "Types:\t%s\n", orDash(strings.Join(p.AllowedTypes, ",")))
+		fmt.Fprintf(w, "Subdir:\t%s\n", orDash(p.Subdir))
+		fmt.Fprintf(w, "Dirs:\t%s\n", orDash(strings.Join(p.AllowedDirs, ",")))
+	}
+	for _, r := range e.Rotations {
+		fmt.Fprintf(w, "Rotated:\t%s %s -> %s\n", formatTime(r.At), r.From, r.To)
+	}
+
+	return w.Flush()
+}
+
+func trustRemoveAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	id := cmd.Args().Get(0)
+	if err := t.Remove(id); err != nil {
+		return err
+	}
+
+	fmt.Printf("Peer '%s' is no longer trusted\n", id)
+	return nil
+}
+
+func trustRenameAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 2); err != nil {
+		return err
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	return t.Rename(cmd.Args().Get(0), cmd.Args().Get(1))
+}
+
+func trustNoteAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 2); err != nil {
+		return err
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	return t.SetNote(cmd.Args().Get(0), cmd.Args().Get(1))
+}
+
+func trustAddAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 2); err != nil {
+		return err
+	}
+
+	id := cmd.Args().Get(0)
+	fingerprint := cmd.Args().Get(1)
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Add(id, fingerprint); err != nil {
+		return err
+	}
+
+	fmt.Printf("Peer '%s' is now pinned to %s\n", id, fingerprint)
+	return nil
+}
+
+func trustReplaceAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 2); err != nil {
+		return err
+	}
+
+	id := cmd.Args().Get(0)
+	fingerprint := cmd.Args().Get(1)
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Replace(id, fingerprint); err != nil {
+		return err
+	}
+
+	fmt.Printf("Peer '%s' is now pinned to %s\n", id, fingerprint)
+	return nil
+}
+
+func trustAllowAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	p := tofu.Permissions{
+		AutoAccept:   cmd.Bool("auto-accept"),
+		AllowedTypes: cmd.StringSlice("type"),
+		Subdir:       cmd.String("subdir"),
+		AllowedDirs:  cmd.StringSlice("dir"),
+	}
+
+	if s := cmd.String("max-bytes"); s != "" {
+		n, err := humanize.ParseBytes(s)
+		if err != nil {
+			return err
+		}
+		p.MaxBytes = n
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	id := cmd.Args().Get(0)
+	if err := t.SetPermissions(id, p); err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated the permissions of '%s'\n", id)
+	return nil
+}
+
+func maxBytes(n uint64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return humanize.Bytes(n)
+}
+
+func trustBlockAction(ctx context.Context, cmd *cli.Command) error {
+	if cmd.NArg() != 1 && cmd.NArg() != 2 {
+		return requireArgs(cmd, 1)
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	target := cmd.Args().Get(0)
+	if err := t.Block(target, cmd.Args().Get(1)); err != nil {
+		return err
+	}
+
+	fmt.Printf("'%s' is now blocked\n", target)
+	return nil
+}
+
+func trustUnblockAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	target := cmd.Args().Get(0)
+	if err := t.Unblock(target); err != nil {
+		return err
+	}
+
+	fmt.Printf("'%s' is no longer blocked\n", target)
+	return nil
+}
+
+func trustBlockedAction(ctx context.Context, cmd *cli.Command) error {
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	blocks, err := t.Blocks()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFINGERPRINT\tBLOCKED\tREASON")
+	for _, b := range blocks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			orDash(b.ID),
+			orDash(b.Fingerprint),
+			formatTime(b.At),
+			orDash(b.Reason),
+		)
+	}
+
+	return w.Flush()
+}
+
+func trustExportAction(ctx context.Context, cmd *cli.Command) error {
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.NArg() == 0 {
+		return t.Export(os.Stdout)
+	}
+
+	file, err := os.OpenFile(cmd.Args().Get(0), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return t.Export(file)
+}
+
+func trustImportAction(ctx context.Context, cmd *cli.Command) error {
+	if err := requireArgs(cmd, 1); err != nil {
+		return err
+	}
+
+	t, err := trustStore(cmd)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if path := cmd.Args().Get(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	n, err := t.Import(r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d trusted peers\n", n)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
 	"sync"
 	"time"
@@ -16,30 +17,144 @@ import (
 )
 
 const (
-	TypeBroadcastMessageError = "error"
-	TypeBroadcastMessageHello = "hello"
+	TypeBroadcastMessageError   = "error"
+	TypeBroadcastMessageHello   = "hello"
+	TypeBroadcastMessageQuery   = "query"
+	TypeBroadcastMessageGoodbye = "goodbye"
+
+	RoleReceiver = "receiver"
+	RoleSender   = "sender"
+	RoleBoth     = "both"
+
+	StatusAvailable = "available"
+	StatusBusy      = "busy"
+	StatusDND       = "dnd"
+
+	FeatureTLS   = "tls"
+	FeatureTOFU  = "tofu"
+	FeatureQuery = "query"
+	FeatureGroup = "group"
+	FeatureSAS   = "sas"
 )
 
 var (
 	ErrMalformedBroadcastMessage = errors.New("malformed broadcast message")
 	HelloInterval                = time.Second * 2
 	validTypes                   = map[string]bool{
-		TypeBroadcastMessageHello: true,
-		TypeBroadcastMessageError: true,
+		TypeBroadcastMessageHello:   true,
+		TypeBroadcastMessageQuery:   true,
+		TypeBroadcastMessageGoodbye: true,
+		TypeBroadcastMessageError:   true,
 	}
+	validRoles = map[string]bool{
+		RoleReceiver: true,
+		RoleSender:   true,
+		RoleBoth:     true,
+	}
+	validStatuses = map[string]bool{
+		StatusAvailable: true,
+		StatusBusy:      true,
+		StatusDND:       true,
+	}
+	Features = []string{FeatureTLS, FeatureTOFU, FeatureQuery, FeatureGroup, FeatureSAS}
 )
 
+// Presence describes what a peer announces about itself in hello messages.
+// Every field is optional on the wire so older peers still parse.
+type Presence struct {
+	Role        string   `json:"role,omitempty"`
+	Proto       uint8    `json:"proto,omitempty"`
+	Features    []string `json:"features,omitempty"`
+	OS          string   `json:"os,omitempty"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+}
+
 type BroadcastMessage struct {
 	Type string `json:"type"`
 	Data string `json:"data"`
 	Name string `json:"name"`
+	Presence
+
+	// Set by Group.Sign, see group.go
+	Group     string `json:"group,omitempty"`
+	Timestamp int64  `json:"ts,omitempty"`
+	MAC       string `json:"mac,omitempty"`
+}
+
+// Peer is a snapshot of a known peer, Data holds the address it accepts transfers on.
+type Peer struct {
+	Name      string
+	Data      string
+	Addr      *net.UDPAddr
+	LastHello time.Time
+	Presence  Presence
+	Source    string
+}
+
+type PeerEventType uint8
+
+const (
+	PeerJoined PeerEventType = iota + 1
+	PeerUpdated
+	PeerLeft
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerJoined:
+		return "joined"
+	case PeerUpdated:
+		return "updated"
+	case PeerLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerEvent is emitted to subscribers whenever the peer set changes,
+// Peer is a copy and safe to keep.
+type PeerEvent struct {
+	Type PeerEventType
+	Peer Peer
+}
+
+func NewPresence(role string) Presence {
+	return Presence{
+		Role:        role,
+		Proto:       Version,
+		Features:    Features,
+		OS:          runtime.GOOS,
+		DisplayName: Hostname(),
+		Status:      StatusAvailable,
+	}
+}
+
+// CanAccept reports whether the peer announced itself as able to take transfers.
+// Peers that predate presence info announce nothing and are assumed to accept.
+func (p *Peer) CanAccept() bool {
+	if p.Presence.Role == RoleSender {
+		return false
+	}
+
+	if p.Presence.Status == StatusDND {
+		return false
+	}
+
+	if p.Presence.Proto != 0 && p.Presence.Proto != Version {
+		return false
+	}
+
+	return true
 }
 
-type peer struct {
-	name      string
-	data      string
-	addr      *net.UDPAddr
-	lastHello time.Time
+func (p *Peer) DisplayName() string {
+	if p.Presence.DisplayName != "" {
+		return p.Presence.DisplayName
+	}
+	return p.Name
 }
 
 type EncodedUDPMessage []byte
@@ -56,6 +171,7 @@ type out struct {
 
 type Broadcaster struct {
 	addr                string
+	name                string
 	ln                  *net.UDPConn
 	inch                chan *in
 	outch               chan *out
@@ -64,18 +180,26 @@ type Broadcaster struct {
 	encodedMalformedMsg *EncodedUDPMessage
 	receiveOnly         bool
 
-	mu    sync.Mutex
-	peers map[string]*peer
+	mu       sync.Mutex
+	peers    map[string]*Peer
+	presence Presence
+	group    *Group
+	blocked  func(name, fingerprint string) bool
+	subs     map[int]chan PeerEvent
+	nextSub  int
 }
 
 func NewBroadcaster(addr string, message any) *Broadcaster {
 	b := &Broadcaster{
 		addr:        addr,
+		name:        Hostname(),
 		inch:        make(chan *in, 100),
 		outch:       make(chan *out, 100),
-		peers:       make(map[string]*peer),
+		peers:       make(map[string]*Peer),
+		subs:        make(map[int]chan PeerEvent),
 		message:     message,
 		receiveOnly: false,
+		presence:    NewPresence(RoleBoth),
 	}
 
 	b.encodedHelloMsg = b.createHelloBroadcastMessage(message)
@@ -87,22 +211,113 @@ func NewBroadcaster(addr string, message any) *Broadcaster {
 func NewReceiveOnlyBroadcaster(addr string) *Broadcaster {
 	b := &Broadcaster{
 		addr:        addr,
+		name:        Hostname(),
 		inch:        make(chan *in, 100),
 		outch:       make(chan *out, 100),
-		peers:       make(map[string]*peer),
+		peers:       make(map[string]*Peer),
+		subs:        make(map[int]chan PeerEvent),
 		receiveOnly: true,
 	}
 
 	return b
 }
 
+// SetPresence replaces the announced presence, the next hello carries it.
+func (b *Broadcaster) SetPresence(presence Presence) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.presence = presence
+	b.encodedHelloMsg = b.createHelloBroadcastMessage(b.message)
+}
+
+// SetName sets the name we announce, it must be our tofu ID so peers can
+// block it.
+func (b *Broadcaster) SetName(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.name = name
+	b.encodedHelloMsg = b.createHelloBroadcastMessage(b.message)
+}
+
+// SetGroup limits discovery to peers in the same group, nil leaves the group.
+func (b *Broadcaster) SetGroup(group *Group) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.group = group
+	b.encodedHelloMsg = b.createHelloBroadcastMessage(b.message)
+
+	// Drop peers we can no longer vouch for, the next hellos bring back the ones in our group
+	for name, p := range b.peers {
+		if p.Source == SourceDiscovered {
+			delete(b.peers, name)
+			b.emit(PeerLeft, p)
+		}
+	}
+}
+
+// SetBlocked hides peers blocked reports true for, given the name and
+// fingerprint they announce. Peers already known are dropped right away.
+func (b *Broadcaster) SetBlocked(blocked func(name, fingerprint string) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.blocked = blocked
+
+	for name, p := range b.peers {
+		if blocked(p.Name, p.Presence.Fingerprint) {
+			delete(b.peers, name)
+			b.emit(PeerLeft, p)
+		}
+	}
+}
+
+// SetStatus updates only the announced status, see StatusAvailable, StatusBusy and StatusDND.
+func (b *Broadcaster) SetStatus(status string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.presence.Status == status {
+		return
+	}
+
+	b.presence.Status = status
+	b.encodedHelloMsg = b.createHelloBroadcastMessage(b.message)
+}
+
+func (b *Broadcaster) Presence() Presence {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.presence
+}
+
+func (b *Broadcaster) helloMsg() *EncodedUDPMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.encodedHelloMsg
+}
+
 func (b *Broadcaster) createHelloBroadcastMessage(message any) *EncodedUDPMessage {
-	hello := &BroadcastMessage{
-		Type: TypeBroadcastMessageHello,
-		Data: fmt.Sprintf("%v", message),
-		Name: hostname(),
+	return b.createPresenceBroadcastMessage(TypeBroadcastMessageHello, message)
+}
+
+// createPresenceBroadcastMessage encodes a message of the given type carrying our presence,
+// queries and goodbyes carry it too so the receiving side can record or drop us right away
+func (b *Broadcaster) createPresenceBroadcastMessage(msgType string, message any) *EncodedUDPMessage {
+	msg := &BroadcastMessage{
+		Type:     msgType,
+		Data:     fmt.Sprintf("%v", message),
+		Name:     b.name,
+		Presence: b.presence,
+	}
+	if err := b.group.Sign(msg); err != nil {
+		panic(err)
 	}
-	encoded, err := hello.Encoded()
+	encoded, err := msg.Encoded()
 	if err != nil {
 		panic(err)
 	}
@@ -113,7 +328,7 @@ func (b *Broadcaster) createMalformedBroadcastMessage() *EncodedUDPMessage {
 	malformed := &BroadcastMessage{
 		Type: TypeBroadcastMessageError,
 		Data: "Malformed message",
-		Name: hostname(),
+		Name: Hostname(),
 	}
 	encoded, err := malformed.Encoded()
 	if err != nil {
@@ -133,7 +348,7 @@ func (e *EncodedUDPMessage) Parse() (*BroadcastMessage, error) {
 		return &BroadcastMessage{
 			Type: TypeBroadcastMessageError,
 			Data: "Malformed message",
-			Name: hostname(),
+			Name: Hostname(),
 		}, ErrMalformedBroadcastMessage
 	}
 
@@ -141,7 +356,7 @@ func (e *EncodedUDPMessage) Parse() (*BroadcastMessage, error) {
 		return &BroadcastMessage{
 			Type: TypeBroadcastMessageError,
 			Data: "Invalid message type",
-			Name: hostname(),
+			Name: Hostname(),
 		}, ErrMalformedBroadcastMessage
 	}
 
@@ -149,7 +364,23 @@ func (e *EncodedUDPMessage) Parse() (*BroadcastMessage, error) {
 		return &BroadcastMessage{
 			Type: TypeBroadcastMessageError,
 			Data: "Missing name field",
-			Name: hostname(),
+			Name: Hostname(),
+		}, ErrMalformedBroadcastMessage
+	}
+
+	if bm.Role != "" && !validRoles[bm.Role] {
+		return &BroadcastMessage{
+			Type: TypeBroadcastMessageError,
+			Data: "Invalid role",
+			Name: Hostname(),
+		}, ErrMalformedBroadcastMessage
+	}
+
+	if bm.Status != "" && !validStatuses[bm.Status] {
+		return &BroadcastMessage{
+			Type: TypeBroadcastMessageError,
+			Data: "Invalid status",
+			Name: Hostname(),
 		}, ErrMalformedBroadcastMessage
 	}
 
@@ -216,22 +447,54 @@ func (b *Broadcaster) Close() error {
 	return nil
 }
 
-func (b *Broadcaster) GetPeers() map[string]*peer {
+// GetPeers returns a snapshot of the current peers, the copies are safe to keep.
+func (b *Broadcaster) GetPeers() map[string]*Peer {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	peers := make(map[string]*peer)
+	peers := make(map[string]*Peer)
 	for k, v := range b.peers {
-		peers[k] = &peer{
-			name:      v.name,
-			data:      v.data,
-			addr:      v.addr,
-			lastHello: v.lastHello,
-		}
+		p := *v
+		peers[k] = &p
 	}
 	return peers
 }
 
+// Subscribe returns a channel of peer events and a function to stop the subscription.
+// Events are dropped when the subscriber falls behind, call GetPeers after
+// subscribing to get the initial set and to resync.
+func (b *Broadcaster) Subscribe() (<-chan PeerEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan PeerEvent, 64)
+	id := b.nextSub
+	b.nextSub++
+	b.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			delete(b.subs, id)
+			close(ch)
+		})
+	}
+}
+
+// emit must be called with b.mu held
+func (b *Broadcaster) emit(t PeerEventType, p *Peer) {
+	ev := PeerEvent{Type: t, Peer: *p}
+	for _, ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
 func (b *Broadcaster) Start(ctx context.Context) error {
 	err := b.Init()
 	if err != nil {
@@ -239,6 +502,22 @@ func (b *Broadcaster) Start(ctx context.Context) error {
 	}
 	defer b.Close()
 
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// ReadFromUDP blocks, so closing the socket is the only way to stop reading;
+	// say goodbye first so peers drop us immediately instead of waiting for expiry
+	go func() {
+		select {
+		case <-ctx.Done():
+			if !b.receiveOnly {
+				b.goodbye()
+			}
+			b.ln.Close()
+		case <-stop:
+		}
+	}()
+
 	if !b.receiveOnly {
 		go b.b(ctx)
 	}
@@ -264,6 +543,12 @@ func (b *Broadcaster) Start(ctx context.Context) error {
 		default:
 			n, remoteAddr, err := b.ln.ReadFromUDP(buf)
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					return err
+				}
 				log.Printf("[err] %v\n", err)
 				continue
 			}
@@ -290,69 +575,197 @@ func (b *Broadcaster) listenBytes(ctx context.Context) error {
 		case in := <-b.inch:
 			msg, err := in.bytes.Parse()
 
-			switch msg.Type {
-			case TypeBroadcastMessageError:
+			if msg.Type == TypeBroadcastMessageError {
 				if err != nil {
 					log.Printf("[err] %v", err)
 				}
 				if !b.receiveOnly {
 					go b.write(&out{bytes: b.encodedMalformedMsg, addr: in.addr})
 				}
+				continue
+			}
+
+			// Peers outside our group and blocked peers are invisible, we
+			// don't even answer their queries
+			if !b.accepts(msg) {
+				continue
+			}
+
+			switch msg.Type {
 			case TypeBroadcastMessageHello:
-				hn := msg.Name
-
-				b.mu.Lock()
-				if _, ok := b.peers[hn]; !ok {
-					b.peers[hn] = &peer{
-						addr:      in.addr,
-						lastHello: time.Now(),
-						data:      msg.Data,
-						name:      hn,
-					}
-				} else {
-					b.peers[hn].lastHello = time.Now()
+				b.record(msg, in.addr)
+			case TypeBroadcastMessageQuery:
+				b.record(msg, in.addr)
+
+				// Answer over unicast so the querying peer doesn't wait for our next hello
+				if !b.receiveOnly {
+					go b.write(&out{bytes: b.helloMsg(), addr: in.addr})
 				}
-				b.mu.Unlock()
+			case TypeBroadcastMessageGoodbye:
+				b.remove(msg.Name, in.addr)
 			}
 		}
 	}
 }
 
-func (b *Broadcaster) b(ctx context.Context) error {
-	ticker := time.NewTicker(HelloInterval)
-	defer ticker.Stop()
+func (b *Broadcaster) accepts(msg *BroadcastMessage) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	_, port, err := net.SplitHostPort(b.addr)
+	return b.admits(msg)
+}
+
+// admits is accepts with b.mu held
+func (b *Broadcaster) admits(msg *BroadcastMessage) bool {
+	if b.blocked != nil && b.blocked(msg.Name, msg.Fingerprint) {
+		return false
+	}
+
+	return b.group.Accepts(msg)
+}
+
+func (b *Broadcaster) record(msg *BroadcastMessage, addr *net.UDPAddr) {
+	hn := msg.Name
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.peers[hn]
+	if !ok {
+		p = &Peer{
+			Addr:      addr,
+			LastHello: time.Now(),
+			Data:      msg.Data,
+			Name:      hn,
+			Presence:  msg.Presence,
+			Source:    SourceDiscovered,
+		}
+		b.peers[hn] = p
+		b.emit(PeerJoined, p)
+		return
+	}
+
+	// Static peers stay static, they just got fresher info
+	if p.Source != SourceStatic {
+		p.Source = SourceDiscovered
+	}
+
+	p.LastHello = time.Now()
+	p.Addr = addr
+	p.Data = msg.Data
+	p.Presence = msg.Presence
+	b.emit(PeerUpdated, p)
+}
+
+// remove drops a peer that said goodbye from addr, a goodbye from anywhere
+// but where the peer was last heard from is ignored
+func (b *Broadcaster) remove(name string, addr *net.UDPAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p, ok := b.peers[name]; ok && p.Source != SourceStatic && sameAddr(p.Addr, addr) {
+		delete(b.peers, name)
+		b.emit(PeerLeft, p)
+	}
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// expire drops peers we haven't heard from in a while
+func (b *Broadcaster) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, p := range b.peers {
+		if p.Source == SourceStatic {
+			continue
+		}
+
+		// Probed peers are only refreshed every ProbeInterval
+		timeout := HelloInterval + 2*time.Second
+		if p.Source == SourceCache {
+			timeout = 2 * ProbeInterval
+		}
+
+		if time.Since(p.LastHello) > timeout {
+			delete(b.peers, name)
+			b.emit(PeerLeft, p)
+		}
+	}
+}
+
+// Query broadcasts a "who is there" probe, peers answer with a unicast hello.
+func (b *Broadcaster) Query() error {
+	broadcastAddr, err := b.broadcastAddr()
 	if err != nil {
 		return err
 	}
 
-	broadcastAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("255.255.255.255:%s", port))
+	b.mu.Lock()
+	query := b.createPresenceBroadcastMessage(TypeBroadcastMessageQuery, b.message)
+	b.mu.Unlock()
+
+	_, err = b.write(&out{bytes: query, addr: broadcastAddr})
+	return err
+}
+
+func (b *Broadcaster) goodbye() {
+	broadcastAddr, err := b.broadcastAddr()
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	goodbye := b.createPresenceBroadcastMessage(TypeBroadcastMessageGoodbye, b.message)
+	b.mu.Unlock()
+
+	b.write(&out{bytes: goodbye, addr: broadcastAddr})
+}
+
+func (b *Broadcaster) broadcastAddr() (*net.UDPAddr, error) {
+	_, port, err := net.SplitHostPort(b.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.ResolveUDPAddr("udp", fmt.Sprintf("255.255.255.255:%s", port))
+}
+
+func (b *Broadcaster) b(ctx context.Context) error {
+	ticker := time.NewTicker(HelloInterval)
+	defer ticker.Stop()
+
+	broadcastAddr, err := b.broadcastAddr()
 	if err != nil {
 		return err
 	}
 
-	go b.write(&out{bytes: b.encodedHelloMsg, addr: broadcastAddr})
+	go b.write(&out{bytes: b.helloMsg(), addr: broadcastAddr})
+
+	// Peers that look for receivers ask who is there instead of waiting a full HelloInterval
+	if b.Presence().Role != RoleReceiver {
+		go b.Query()
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			go b.write(&out{bytes: b.encodedHelloMsg, addr: broadcastAddr})
+			go b.write(&out{bytes: b.helloMsg(), addr: broadcastAddr})
 
-			b.mu.Lock()
-			for name, peer := range b.peers {
-				if time.Since(peer.lastHello) > HelloInterval+2*time.Second {
-					delete(b.peers, name)
-				}
-			}
-			b.mu.Unlock()
+			b.expire()
 		}
 	}
 }
 
-func hostname() string {
+// Hostname is the name we announce and the ID in our certificate.
+func Hostname() string {
 	hn, err := os.Hostname()
 	if err != nil {
 		hn = fmt.Sprintf("%s-%s", "unknown", uuid.NewString())
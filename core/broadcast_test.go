@@ -1,7 +1,9 @@
 package core
 
 import (
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,7 +37,7 @@ func TestBroadcastServer(t *testing.T) {
 	_, err = conn.Write(*encodedHeader)
 	require.NoError(t, err)
 
-	var peer *peer
+	var peer *Peer
 	var found bool
 	for range 10 {
 		time.Sleep(time.Millisecond * 50)
@@ -48,8 +50,8 @@ func TestBroadcastServer(t *testing.T) {
 	}
 
 	require.True(t, found, "expected peer TEST, but not found")
-	assert.Equal(t, "TEST", peer.name)
-	assert.Equal(t, msg.Data, peer.data)
+	assert.Equal(t, "TEST", peer.Name)
+	assert.Equal(t, msg.Data, peer.Data)
 }
 
 func TestPeerDelete(t *testing.T) {
@@ -159,3 +161,353 @@ func TestInvalidMessageType(t *testing.T) {
 	assert.Equal(t, TypeBroadcastMessageError, response.Type)
 	assert.Equal(t, "Malformed message", response.Data)
 }
+
+func TestHelloPresence(t *testing.T) {
+	b := NewBroadcaster(":8084", ":42069")
+	ctx := t.Context()
+
+	go b.Start(ctx)
+	time.Sleep(time.Millisecond * 50)
+
+	addr, err := net.ResolveUDPAddr("udp", "localhost:8084")
+	require.NoError(t, err)
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := &BroadcastMessage{
+		Type:     TypeBroadcastMessageHello,
+		Data:     ":42069",
+		Name:     "TEST",
+		Presence: NewPresence(RoleReceiver),
+	}
+	msg.DisplayName = "Test Machine"
+
+	encoded, err := msg.Encoded()
+	require.NoError(t, err)
+
+	_, err = conn.Write(*encoded)
+	require.NoError(t, err)
+
+	var peer *Peer
+	for range 10 {
+		time.Sleep(time.Millisecond * 50)
+		if p, ok := b.GetPeers()["TEST"]; ok {
+			peer = p
+			break
+		}
+	}
+
+	require.NotNil(t, peer, "expected peer TEST, but not found")
+	assert.Equal(t, RoleReceiver, peer.Presence.Role)
+	assert.Equal(t, Version, peer.Presence.Proto)
+	assert.Equal(t, StatusAvailable, peer.Presence.Status)
+	assert.Equal(t, Features, peer.Presence.Features)
+	assert.Equal(t, "Test Machine", peer.DisplayName())
+	assert.True(t, peer.CanAccept())
+}
+
+func TestInvalidPresence(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  EncodedUDPMessage
+		data string
+	}{
+		{
+			name: "invalid role",
+			msg:  EncodedUDPMessage(`{"type":"hello","data":"test","name":"TEST","role":"invalid"}`),
+			data: "Invalid role",
+		},
+		{
+			name: "invalid status",
+			msg:  EncodedUDPMessage(`{"type":"hello","data":"test","name":"TEST","status":"invalid"}`),
+			data: "Invalid status",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := tt.msg.Parse()
+			assert.Equal(t, ErrMalformedBroadcastMessage, err)
+			assert.Equal(t, TypeBroadcastMessageError, h.Type)
+			assert.Equal(t, tt.data, h.Data)
+		})
+	}
+}
+
+func TestPeerCanAccept(t *testing.T) {
+	tests := []struct {
+		name     string
+		presence Presence
+		want     bool
+	}{
+		{
+			name:     "legacy peer",
+			presence: Presence{},
+			want:     true,
+		},
+		{
+			name:     "receiver",
+			presence: Presence{Role: RoleReceiver, Proto: Version, Status: StatusAvailable},
+			want:     true,
+		},
+		{
+			name:     "busy receiver",
+			presence: Presence{Role: RoleBoth, Proto: Version, Status: StatusBusy},
+			want:     true,
+		},
+		{
+			name:     "sender",
+			presence: Presence{Role: RoleSender, Proto: Version, Status: StatusAvailable},
+			want:     false,
+		},
+		{
+			name:     "do not disturb",
+			presence: Presence{Role: RoleReceiver, Proto: Version, Status: StatusDND},
+			want:     false,
+		},
+		{
+			name:     "incompatible protocol",
+			presence: Presence{Role: RoleReceiver, Proto: Version + 1, Status: StatusAvailable},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Peer{Name: "TEST", Presence: tt.presence}
+			assert.Equal(t, tt.want, p.CanAccept())
+		})
+	}
+}
+
+func TestQueryAnsweredWithHello(t *testing.T) {
+	b := NewBroadcaster(":8085", ":42069")
+	ctx := t.Context()
+
+	go b.Start(ctx)
+	time.Sleep(time.Millisecond * 50)
+
+	addr, err := net.ResolveUDPAddr("udp", "localhost:8085")
+	require.NoError(t, err)
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := &BroadcastMessage{
+		Type:     TypeBroadcastMessageQuery,
+		Data:     ":42069",
+		Name:     "TEST",
+		Presence: NewPresence(RoleSender),
+	}
+
+	encoded, err := msg.Encoded()
+	require.NoError(t, err)
+
+	_, err = conn.Write(*encoded)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFromUDP(buf)
+	require.NoError(t, err)
+
+	encodedBytes := EncodedUDPMessage(buf[:n])
+	response, err := encodedBytes.Parse()
+	require.NoError(t, err)
+
+	assert.Equal(t, TypeBroadcastMessageHello, response.Type)
+	assert.Equal(t, ":42069", response.Data)
+
+	peers := b.GetPeers()
+	require.Contains(t, peers, "TEST")
+	assert.Equal(t, RoleSender, peers["TEST"].Presence.Role)
+}
+
+func TestGoodbyeRemovesPeer(t *testing.T) {
+	b := NewBroadcaster(":8086", ":42069")
+	ctx := t.Context()
+
+	go b.Start(ctx)
+	time.Sleep(time.Millisecond * 50)
+
+	addr, err := net.ResolveUDPAddr("udp", "localhost:8086")
+	require.NoError(t, err)
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, msgType := range []string{TypeBroadcastMessageHello, TypeBroadcastMessageGoodbye} {
+		msg := &BroadcastMessage{
+			Type: msgType,
+			Data: ":42069",
+			Name: "TEST",
+		}
+
+		encoded, err := msg.Encoded()
+		require.NoError(t, err)
+
+		_, err = conn.Write(*encoded)
+		require.NoError(t, err)
+
+		time.Sleep(time.Millisecond * 100)
+
+		_, found := b.GetPeers()["TEST"]
+		assert.Equal(t, msgType == TypeBroadcastMessageHello, found)
+	}
+}
+
+func TestGoodbyeFromElsewhere(t *testing.T) {
+	b := NewBroadcaster(":8092", ":42069")
+	ctx := t.Context()
+
+	go b.Start(ctx)
+	time.Sleep(time.Millisecond * 50)
+
+	addr, err := net.ResolveUDPAddr("udp", "localhost:8092")
+	require.NoError(t, err)
+
+	peer, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	defer peer.Close()
+
+	impostor, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	defer impostor.Close()
+
+	for _, send := range []struct {
+		conn    *net.UDPConn
+		msgType string
+	}{{peer, TypeBroadcastMessageHello}, {impostor, TypeBroadcastMessageGoodbye}} {
+		msg := &BroadcastMessage{Type: send.msgType, Data: ":42069", Name: "TEST"}
+
+		encoded, err := msg.Encoded()
+		require.NoError(t, err)
+
+		_, err = send.conn.Write(*encoded)
+		require.NoError(t, err)
+
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	assert.Contains(t, b.GetPeers(), "TEST", "a goodbye from another address removed the peer")
+}
+
+func TestPeerEvents(t *testing.T) {
+	b := NewBroadcaster(":8087", ":42069")
+
+	events, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	hello := &BroadcastMessage{Type: TypeBroadcastMessageHello, Data: ":42069", Name: "TEST"}
+
+	b.record(hello, nil)
+	b.record(hello, nil)
+	b.remove("TEST", nil)
+	b.remove("TEST", nil)
+
+	for _, want := range []PeerEventType{PeerJoined, PeerUpdated, PeerLeft} {
+		select {
+		case ev := <-events:
+			assert.Equal(t, want, ev.Type)
+			assert.Equal(t, "TEST", ev.Peer.Name)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s event", want)
+		}
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected %s event", ev.Type)
+	default:
+	}
+
+	unsubscribe()
+	_, open := <-events
+	assert.False(t, open, "expected channel to be closed after unsubscribe")
+}
+
+func TestPeerEventsExpire(t *testing.T) {
+	b := NewBroadcaster(":8088", ":42069")
+
+	events, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	b.record(&BroadcastMessage{Type: TypeBroadcastMessageHello, Data: ":42069", Name: "TEST"}, nil)
+	<-events
+
+	b.mu.Lock()
+	b.peers["TEST"].LastHello = time.Now().Add(-time.Minute)
+	b.mu.Unlock()
+
+	b.expire()
+
+	ev := <-events
+	assert.Equal(t, PeerLeft, ev.Type)
+	assert.Empty(t, b.GetPeers())
+}
+
+// Run with -race, the selector and snapshots are read while peers churn
+func TestPeerEventsConcurrent(t *testing.T) {
+	b := NewBroadcaster(":8089", ":42069")
+	ps := NewPeerSelector(nil)
+
+	events, unsubscribe := b.Subscribe()
+	ps.UpdatePeers(b.GetPeers())
+
+	followed := make(chan struct{})
+	go func() {
+		defer close(followed)
+		ps.Follow(events)
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("TEST-%d", i)
+			for range 100 {
+				b.record(&BroadcastMessage{Type: TypeBroadcastMessageHello, Data: ":42069", Name: name}, nil)
+				b.expire()
+				b.GetPeers()
+				ps.filteredPeers()
+				b.remove(name, nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	unsubscribe()
+	<-followed
+
+	// Events may have been dropped under churn, a snapshot resyncs the selector
+	ps.UpdatePeers(b.GetPeers())
+
+	assert.Empty(t, b.GetPeers())
+	assert.Empty(t, ps.filteredPeers())
+}
+
+func TestBlockedPeersHidden(t *testing.T) {
+	b := NewReceiveOnlyBroadcaster(":42069")
+
+	b.record(&BroadcastMessage{Type: TypeBroadcastMessageHello, Data: ":8080", Name: "nuisance"}, nil)
+	b.record(&BroadcastMessage{Type: TypeBroadcastMessageHello, Data: ":8080", Name: "friend"}, nil)
+
+	b.SetBlocked(func(name, fingerprint string) bool {
+		return name == "nuisance" || fingerprint == "sha256:blocked"
+	})
+
+	peers := b.GetPeers()
+	assert.NotContains(t, peers, "nuisance", "blocked peers already known should be dropped")
+	assert.Contains(t, peers, "friend")
+
+	renamed := &BroadcastMessage{Type: TypeBroadcastMessageHello, Data: ":8080", Name: "someone-else"}
+	renamed.Fingerprint = "sha256:blocked"
+	assert.False(t, b.accepts(renamed), "peers announcing a blocked fingerprint should be hidden")
+	assert.True(t, b.accepts(&BroadcastMessage{Type: TypeBroadcastMessageHello, Data: ":8080", Name: "friend"}))
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrCancelled = errors.New("transfer cancelled")
+
+// CancelError is a transfer either side cancelled with TypeCancel, it
+// matches ErrCancelled.
+type CancelError struct {
+	// ByPeer is set if the other side cancelled
+	ByPeer bool
+	Reason string
+}
+
+func (e *CancelError) Error() string {
+	reason := e.Reason
+	if reason == "" {
+		reason = "no reason given"
+	}
+
+	if e.ByPeer {
+		return fmt.Sprintf("cancelled by peer: %s", reason)
+	}
+	return fmt.Sprintf("cancelled: %s", reason)
+}
+
+func (e *CancelError) Unwrap() error {
+	return ErrCancelled
+}
+
+// cancelReason is why ctx is done, as told to the other side
+func cancelReason(ctx context.Context) string {
+	cause := context.Cause(ctx)
+	if cause == nil || errors.Is(cause, context.Canceled) {
+		return "interrupted"
+	}
+
+	reason := cause.Error()
+	if ValidateReason(reason) != nil {
+		return "interrupted"
+	}
+	return reason
+}
+
+// writeCancel tells the other side we give up and why
+func writeCancel(p *Proto, w io.Writer, reason string) error {
+	if err := ValidateReason(reason); err != nil {
+		return err
+	}
+
+	header, err := p.SerializeHeader(NewHeader(TypeCancel, uint64(len(reason))))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(header, reason...))
+	return err
+}
+
+// drain discards what r sends until it hangs up, for up to StallTimeout, so a
+// peer we cancelled on reads why before its writes fail
+func drain(r io.Reader) {
+	deadline := time.Now().Add(StallTimeout)
+	buf := make([]byte, ChunkSize)
+
+	for time.Now().Before(deadline) {
+		if _, err := r.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// readCancel reads a TypeCancel payload, the header must already be consumed.
+func readCancel(rd io.Reader, hd *Header) error {
+	buf := make([]byte, hd.Length)
+	_, err := io.ReadFull(rd, buf)
+	if err != nil {
+		return err
+	}
+
+	reason := string(buf)
+	if err := ValidateReason(reason); err != nil {
+		return err
+	}
+
+	return &CancelError{ByPeer: true, Reason: reason}
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cancelAfter cancels a context once more than limit bytes were read from or
+// written to a connection
+type cancelAfter struct {
+	net.Conn
+	limit  int
+	cancel func()
+
+	mu sync.Mutex
+	n  int
+}
+
+func (c *cancelAfter) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(n)
+	return n, err
+}
+
+func (c *cancelAfter) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(n)
+	return n, err
+}
+
+func (c *cancelAfter) count(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.n += n
+	if c.n > c.limit {
+		c.cancel()
+	}
+}
+
+// bigFile is more than a few chunks, so a transfer can be cancelled halfway
+func bigFile(t *testing.T) (map[string]*FileMetadata, *Request) {
+	t.Helper()
+
+	content := strings.Repeat("x", int(ChunkSize)*3)
+	return testFile(t, "big.bin", "notes", content), NewRequest(uint64(len(content)), 1)
+}
+
+func TestSenderCancel(t *testing.T) {
+	dir := t.TempDir()
+	r := NewReceiver(dir)
+	from := &Identity{ID: "friend", Permissions: tofu.Permissions{AutoAccept: true}}
+
+	sender, receiver := net.Pipe()
+	defer receiver.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer sender.Close()
+		done <- r.receive(context.Background(), sender, from)
+	}()
+
+	files, req := bigFile(t)
+	s := NewSender()
+	require.NoError(t, s.WriteRequest(receiver, req))
+	require.NoError(t, s.ReadResponse(receiver))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	conn := &cancelAfter{Conn: receiver, limit: int(ChunkSize), cancel: func() {
+		cancel(errors.New("out of time"))
+	}}
+
+	var cerr *CancelError
+	err := s.Send(ctx, conn, files, req)
+	require.ErrorAs(t, err, &cerr)
+	assert.False(t, cerr.ByPeer)
+	assert.Equal(t, "out of time", cerr.Reason)
+	receiver.Close()
+
+	err = <-done
+	require.ErrorAs(t, err, &cerr)
+	assert.True(t, cerr.ByPeer)
+	assert.Equal(t, "out of time", cerr.Reason)
+	assert.ErrorIs(t, err, ErrCancelled)
+	assert.NoFileExists(t, filepath.Join(dir, "notes", "big.bin"), "partial file left behind")
+}
+
+func TestReceiverCancel(t *testing.T) {
+	dir := t.TempDir()
+	r := NewReceiver(dir)
+	from := &Identity{ID: "friend", Permissions: tofu.Permissions{AutoAccept: true}}
+
+	sender, receiver := net.Pipe()
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	conn := &cancelAfter{Conn: sender, limit: int(ChunkSize), cancel: func() {
+		cancel(errors.New("disk is full"))
+	}}
+
+	done := make(chan error, 1)
+	go func() {
+		defer sender.Close()
+		done <- r.receive(ctx, conn, from)
+	}()
+
+	files, req := bigFile(t)
+	s := NewSender()
+	require.NoError(t, s.WriteRequest(receiver, req))
+	require.NoError(t, s.ReadResponse(receiver))
+
+	var cerr *CancelError
+	err := s.Send(context.Background(), receiver, files, req)
+	require.ErrorAs(t, err, &cerr)
+	assert.True(t, cerr.ByPeer)
+	assert.Equal(t, "cancelled by peer: disk is full", err.Error())
+	receiver.Close()
+
+	err = <-done
+	require.ErrorAs(t, err, &cerr)
+	assert.False(t, cerr.ByPeer)
+	assert.NoFileExists(t, filepath.Join(dir, "notes", "big.bin"), "partial file left behind")
+}
+
+func TestReceiverCancelWhilePrompting(t *testing.T) {
+	r := NewReceiver(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	r.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool {
+		cancel()
+		<-unblock
+		return true
+	}
+
+	sender, receiver := net.Pipe()
+	defer receiver.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer sender.Close()
+		done <- r.receive(ctx, sender, nil)
+	}()
+
+	s := NewSender()
+	require.NoError(t, s.WriteRequest(receiver, NewRequest(5, 1)))
+
+	var cerr *CancelError
+	err := s.ReadResponse(receiver)
+	require.ErrorAs(t, err, &cerr)
+	assert.True(t, cerr.ByPeer)
+	assert.Equal(t, "interrupted", cerr.Reason)
+	receiver.Close()
+
+	assert.ErrorIs(t, <-done, ErrCancelled)
+}
+
+func TestSenderCancelWhilePrompting(t *testing.T) {
+	tests := []struct {
+		name    string
+		give    func(s *Sender, conn net.Conn)
+		wantErr error
+	}{
+		{
+			name: "cancel",
+			give: func(s *Sender, conn net.Conn) {
+				ctx, cancel := context.WithCancelCause(context.Background())
+				cancel(errors.New("changed my mind"))
+				s.Cancel(ctx, conn)
+			},
+			wantErr: ErrCancelled,
+		},
+		{
+			name:    "hang up",
+			give:    func(s *Sender, conn net.Conn) { conn.Close() },
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReceiver(t.TempDir())
+
+			prompted := make(chan struct{})
+			dismissed := make(chan struct{})
+			r.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool {
+				close(prompted)
+				<-ctx.Done()
+				close(dismissed)
+				return true
+			}
+
+			sender, receiver := net.Pipe()
+			defer receiver.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				defer sender.Close()
+				done <- r.receive(context.Background(), newTimeoutConn(sender), nil)
+			}()
+
+			s := NewSender()
+			require.NoError(t, s.WriteRequest(receiver, NewRequest(5, 1)))
+			<-prompted
+			tt.give(s, receiver)
+
+			err := waitErr(t, done)
+			require.ErrorIs(t, err, tt.wantErr)
+			<-dismissed
+
+			var cerr *CancelError
+			if errors.As(err, &cerr) {
+				assert.True(t, cerr.ByPeer)
+				assert.Equal(t, "cancelled by peer: changed my mind", err.Error())
+			}
+		})
+	}
+}
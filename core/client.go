@@ -2,10 +2,16 @@ package core
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Dyastin-0/gobyte/tofu"
 	"github.com/charmbracelet/huh"
@@ -17,18 +23,34 @@ var (
 	ErrInvalidResponse = errors.New("invalid response")
 
 	warningStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
+	dangerStyle  = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("9")).
+			Bold(true).
+			Border(lipgloss.ThickBorder()).
+			BorderForeground(lipgloss.Color("9")).
+			Padding(0, 1)
 )
 
 type Client struct {
 	addr         string
-	sender       *Sender
 	receiver     *Receiver
 	broadcaster  *Broadcaster
 	fileselector *FileSelector
 	peerselector *PeerSelector
+	peercache    *PeerCache
+	group        *Group
 	tofu         *tofu.Tofu
 
-	onRequest func(*Request) bool
+	// sent along with our requests
+	note string
+
+	// serializes OnNewPeer and accept prompts of concurrent connections
+	prompts *PromptBroker
+
+	// number of connections currently being handled, the receiver announces
+	// itself as busy while this is non-zero
+	active atomic.Int32
+	status string
 }
 
 func NewSenderClient(addr, baddr, dir string) *Client {
@@ -38,13 +60,17 @@ func NewSenderClient(addr, baddr, dir string) *Client {
 
 	addr = fmt.Sprintf("%s%s", outboundIP().String(), addr)
 
+	broadcaster := NewBroadcaster(baddr, addr)
+	broadcaster.SetPresence(NewPresence(RoleSender))
+
 	return &Client{
 		addr:         addr,
-		broadcaster:  NewBroadcaster(baddr, addr),
-		sender:       NewSender(),
+		broadcaster:  broadcaster,
 		fileselector: NewFileSelector(dir),
 		peerselector: NewPeerSelector(nil),
-		tofu:         tofu.New(hostname()),
+		tofu:         tofu.New(Hostname()),
+		prompts:      NewPromptBroker(ConfirmPrompt),
+		status:       StatusAvailable,
 	}
 }
 
@@ -55,37 +81,195 @@ func NewReceiverClient(addr, baddr, dir string) *Client {
 
 	addr = fmt.Sprintf("%s%s", outboundIP().String(), addr)
 
-	return &Client{
+	broadcaster := NewBroadcaster(baddr, addr)
+	broadcaster.SetPresence(NewPresence(RoleReceiver))
+
+	c := &Client{
 		addr:         addr,
-		broadcaster:  NewBroadcaster(baddr, addr),
+		broadcaster:  broadcaster,
 		receiver:     NewReceiver(dir),
 		fileselector: NewFileSelector(dir),
 		peerselector: NewPeerSelector(nil),
-		tofu:         tofu.New(hostname()),
-		onRequest:    OnRequest,
+		tofu:         tofu.New(Hostname()),
+		prompts:      NewPromptBroker(ConfirmPrompt),
+		status:       StatusAvailable,
+	}
+
+	c.receiver.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool {
+		return c.prompts.Confirm(ctx, requestTitle(req, from))
 	}
+
+	return c
 }
 
-func (c *Client) StartReceiver(ctx context.Context) error {
+// SetDisplayName sets the human friendly name announced to other peers.
+func (c *Client) SetDisplayName(name string) {
+	if name == "" {
+		return
+	}
+
+	presence := c.broadcaster.Presence()
+	presence.DisplayName = name
+	c.broadcaster.SetPresence(presence)
+}
+
+// AddStaticPeers adds peers that are offered regardless of discovery.
+func (c *Client) AddStaticPeers(peers ...*Peer) {
+	for _, p := range peers {
+		c.broadcaster.AddStaticPeer(p)
+	}
+}
+
+// SetPeerCache sets where recently used peers are remembered and offered
+// again once they are reachable.
+func (c *Client) SetPeerCache(cache *PeerCache) {
+	c.peercache = cache
+}
+
+// SetGroup hides us from, and refuses connections by, peers outside group.
+func (c *Client) SetGroup(group *Group) {
+	c.group = group
+	c.broadcaster.SetGroup(group)
+}
+
+// SetCode pairs with peers that know the same one-time code instead of
+// prompting, and limits discovery to them by the code's public number.
+// It replaces any group.
+func (c *Client) SetCode(code string) error {
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	nameplate, err := tofu.Nameplate(code)
+	if err != nil {
+		return err
+	}
+
+	c.tofu.Code = code
+	c.SetGroup(&Group{Name: "code-" + nameplate})
+
+	return nil
+}
+
+// SetProfile uses the profile's identity and trust database, and announces
+// its ID and display name.
+func (c *Client) SetProfile(p *Profile) {
+	c.tofu.ID = p.ID()
+	c.tofu.Dir = p.Path()
+	c.broadcaster.SetName(p.ID())
+	c.SetDisplayName(p.DisplayName)
+}
+
+// SetNote attaches a note to the requests we send, shown in the receiver's
+// prompt.
+func (c *Client) SetNote(note string) error {
+	if err := ValidateNote(note); err != nil {
+		return err
+	}
+
+	c.note = note
+	return nil
+}
+
+// SetQuota limits what the receiver accepts, see Quota.
+func (c *Client) SetQuota(q Quota) {
+	c.receiver.Quota = q
+}
+
+// SetPromptTimeout denies trust and accept prompts left unanswered for d,
+// queued time included. 0 waits forever.
+func (c *Client) SetPromptTimeout(d time.Duration) {
+	c.prompts.Timeout = d
+}
+
+// SetPassphrase sets where the passphrase of an encrypted private key comes
+// from.
+func (c *Client) SetPassphrase(passphrase tofu.PassphraseFunc) {
+	c.tofu.Passphrase = passphrase
+}
+
+// SetKeyAlgorithm sets the key type used if we have no identity yet or rotate
+// it, see tofu.ParseAlgorithm.
+func (c *Client) SetKeyAlgorithm(algorithm string) {
+	c.tofu.Algorithm = algorithm
+}
+
+// SetTrustPolicy trusts peers whose certificate one of cas signed without
+// pairing, unless crls revoked it, see tofu.Policy.
+func (c *Client) SetTrustPolicy(policy tofu.Policy, cas *x509.CertPool, crls []*x509.RevocationList) {
+	c.tofu.Policy = policy
+	c.tofu.CAs = cas
+	c.tofu.CRLs = crls
+}
+
+// SetStatus sets the status announced while idle, StatusDND hides the
+// receiver from other peers' lists.
+func (c *Client) SetStatus(status string) {
+	c.status = status
+	c.broadcaster.SetStatus(status)
+}
+
+// initTofu loads our identity, announces its fingerprint and hides
+// blocked peers
+func (c *Client) initTofu() error {
 	err := c.tofu.Init()
 	if err != nil {
 		return err
 	}
 
-	// Override default tofu.OnNewPeer
-	c.tofu.OnNewPeer = OnNewPeer
+	// Override default tofu.OnNewPeer, prompts of concurrent handshakes
+	// take turns
+	c.tofu.OnNewPeer = func(id, fingerprint, code string) bool {
+		return c.prompts.Confirm(context.Background(), newPeerTitle(id, fingerprint, code))
+	}
+	c.tofu.OnKeyChanged = func(id, known, presented string) {
+		c.prompts.Print(keyChangedWarning(id, known, presented))
+	}
+	c.tofu.OnShowCode = func(id, code string) {
+		c.prompts.Print(showCodeMessage(id, code))
+	}
 
-	ln, err := c.tofu.Listen(c.addr)
+	leaf, err := c.tofu.Leaf()
+	if err != nil {
+		return err
+	}
+
+	presence := c.broadcaster.Presence()
+	presence.Fingerprint = tofu.Fingerprint(leaf)
+	c.broadcaster.SetPresence(presence)
+
+	c.broadcaster.SetBlocked(func(name, fingerprint string) bool {
+		blocked, err := c.tofu.IsBlocked(name, fingerprint)
+		if err != nil {
+			log.Printf("[err] %v", err)
+		}
+		return blocked
+	})
+
+	return nil
+}
+
+func (c *Client) StartReceiver(ctx context.Context) error {
+	err := c.initTofu()
 	if err != nil {
 		return err
 	}
 
-	// Only send out broadcasts
-	err = c.broadcaster.Init()
+	ln, err := c.tofu.Listen(c.addr)
 	if err != nil {
 		return err
 	}
-	go c.broadcaster.b(ctx)
+
+	// Announce ourselves and answer discovery queries, wait for the
+	// goodbye to go out before returning
+	bctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.broadcaster.Start(bctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
 
 	err = c.listen(ctx, ln)
 	if err != nil {
@@ -96,21 +280,32 @@ func (c *Client) StartReceiver(ctx context.Context) error {
 }
 
 func (c *Client) StartSender(ctx context.Context) error {
-	cancelContext, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	err := c.tofu.Init()
+	err := c.initTofu()
 	if err != nil {
 		return err
 	}
 
-	// Override default tofu.OnNewPeer
-	c.tofu.OnNewPeer = OnNewPeer
+	// Wait for the goodbye to go out before returning
+	cancelContext, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.broadcaster.Start(cancelContext)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Keep the selector's peers in sync with discovery
+	events, unsubscribe := c.broadcaster.Subscribe()
+	defer unsubscribe()
 
-	go c.broadcaster.Start(cancelContext)
+	c.peerselector.UpdatePeers(c.broadcaster.GetPeers())
+	go c.peerselector.Follow(events)
 
-	// Set the peers to selector so we can display them
-	c.peerselector.peers = c.broadcaster.peers
+	// Static and cached peers aren't announced over broadcast, check they're up instead
+	go c.broadcaster.Probe(cancelContext, c.peercache)
 
 	for {
 		select {
@@ -147,45 +342,99 @@ func (c *Client) StartSender(ctx context.Context) error {
 			// How should we display the bars when sending to multiple peers?
 			// How should we display forms when sending to multiple peers at first time?
 			for _, p := range c.peerselector.Selected {
-				conn, err := c.tofu.Dial(p.data)
-				if err != nil {
+				if err := c.sendTo(ctx, p); err != nil {
 					return err
 				}
+			}
 
-				req := NewRequest(
-					uint64(c.fileselector.nBytesSelected),
-					uint32(len(c.fileselector.Selected)),
-				)
+			if !Continue("Do you want to send again? (Yes/No)") {
+				return nil
+			}
+		}
+	}
+}
 
-				err = c.sender.WriteRequest(conn, req)
-				if err != nil {
-					return err
-				}
+// sendTo sends the selected files to p, a peer that is skipped or cancels
+// only gets a warning
+func (c *Client) sendTo(ctx context.Context, p *Peer) error {
+	conn, err := c.tofu.Dial(p.Data)
+	if errors.Is(err, tofu.ErrorPeerKeyChanged) {
+		// Already warned by OnKeyChanged, don't let it stop the other peers
+		return nil
+	}
+	if errors.Is(err, tofu.ErrorPeerBlocked) {
+		fmt.Println(warningStyle.Render(fmt.Sprintf("Skipped '%s', it is blocked", p.DisplayName())))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-				err = c.sender.ReadResponse(conn)
-				if err != nil {
-					return err
-				}
+	// Each connection follows the protocol from the start
+	sender := NewSender()
 
-				err = c.sender.Send(conn, c.fileselector.Selected, req)
-				if err != nil {
-					return err
-				}
+	if c.group.Enabled() {
+		err = c.joinGroup(conn, sender)
+		if err != nil {
+			return err
+		}
+	}
 
-				err = c.sender.WriteEnd(conn)
-				if err != nil {
-					log.Println("[warn] failed to write end, but all files were written")
-					return err
-				}
+	// Pairing sets its own deadline, the rest gives up on a receiver that
+	// stops responding
+	err = conn.Handshake()
+	if err != nil {
+		return err
+	}
+	tc := newTimeoutConn(conn)
 
-				conn.Close()
-			}
+	req := NewRequest(
+		uint64(c.fileselector.nBytesSelected),
+		uint32(len(c.fileselector.Selected)),
+	)
+	req.Note = c.note
 
-			if !Continue("Do you want to send again? (Yes/No)") {
-				return nil
-			}
+	err = sender.WriteRequest(tc, req)
+	if err != nil {
+		return err
+	}
+
+	// The receiver's user may take a while, don't keep ours waiting
+	stop := interruptOnDone(ctx, tc)
+	err = sender.ReadResponse(tc)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		resume(tc)
+		err = sender.Cancel(ctx, tc)
+	}
+
+	if err == nil {
+		err = sender.Send(ctx, tc, c.fileselector.Selected, req)
+	}
+
+	var cerr *CancelError
+	if errors.As(err, &cerr) && cerr.ByPeer {
+		fmt.Println(warningStyle.Render(fmt.Sprintf("Transfer to '%s' was %v", p.DisplayName(), err)))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = sender.WriteEnd(tc)
+	if err != nil {
+		log.Println("[warn] failed to write end, but all files were written")
+		return err
+	}
+
+	if c.peercache != nil {
+		if err := c.peercache.Remember(p.Name, p.Data); err != nil {
+			log.Printf("[warn] failed to update peer cache: %v", err)
 		}
 	}
+
+	return nil
 }
 
 func (c *Client) listen(ctx context.Context, ln net.Listener) error {
@@ -196,6 +445,10 @@ func (c *Client) listen(ctx context.Context, ln net.Listener) error {
 		ln.Close()
 	}()
 
+	// Give transfers in progress the chance to cancel and clean up
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -213,9 +466,48 @@ func (c *Client) listen(ctx context.Context, ln net.Listener) error {
 			continue
 		}
 
+		handlers.Add(1)
 		go func(conn net.Conn) {
+			defer handlers.Done()
 			defer conn.Close()
-			err := c.receiver.receive(conn)
+
+			// Bounds the TLS handshake, pairing and the transfer set their
+			// own deadlines
+			conn.SetDeadline(time.Now().Add(IdleTimeout))
+			stop := context.AfterFunc(ctx, func() {
+				conn.SetDeadline(time.Now())
+			})
+			defer stop()
+
+			if c.group.Enabled() {
+				err := c.checkGroup(conn)
+				if err != nil {
+					refused(conn, err)
+					return
+				}
+			}
+
+			from, err := c.identify(conn)
+			if err != nil {
+				refused(conn, err)
+				return
+			}
+
+			// receive cancels on its own
+			if !stop() {
+				return
+			}
+
+			c.busy()
+			defer c.idle()
+
+			err = c.receiver.receive(ctx, newTimeoutConn(conn), from)
+
+			var cerr *CancelError
+			if errors.As(err, &cerr) && cerr.ByPeer {
+				c.prompts.Print(warningStyle.Render(fmt.Sprintf("Transfer from '%s' was %v", from.ID, err)))
+				return
+			}
 			if err != nil {
 				log.Printf("[err] Connection handler error: %v", err)
 			}
@@ -223,6 +515,116 @@ func (c *Client) listen(ctx context.Context, ln net.Listener) error {
 	}
 }
 
+// joinGroup proves to the receiver that we are in its group, before pairing
+// so peers outside of it never get to prompt anyone
+func (c *Client) joinGroup(conn *tofu.Conn, sender *Sender) error {
+	proof, err := c.group.Proof(conn.ConnectionState())
+	if err != nil {
+		return err
+	}
+
+	tc := newTimeoutConn(conn.Conn)
+
+	err = sender.WriteHello(tc, proof)
+	if err != nil {
+		return err
+	}
+
+	err = sender.ReadResponse(tc)
+	if errors.Is(err, ErrRequestDenied) {
+		return ErrGroupDenied
+	}
+
+	return err
+}
+
+// checkGroup refuses senders that can't prove they're in our group
+// refused logs why conn was turned away. Hanging up before the handshake is
+// how senders probe that we're up, that isn't worth a line.
+func refused(conn net.Conn, err error) {
+	if err == io.EOF {
+		return
+	}
+	log.Printf("[warn] Refused connection from %s: %v", conn.RemoteAddr(), err)
+}
+
+func (c *Client) checkGroup(conn net.Conn) error {
+	tofuConn, ok := conn.(*tofu.Conn)
+	if !ok {
+		return ErrGroupDenied
+	}
+
+	// The raw TLS connection, pairing waits until we know it's a member
+	tlsConn := tofuConn.Conn
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	return c.receiver.ReadGroupHello(newTimeoutConn(tlsConn), c.group, tlsConn.ConnectionState())
+}
+
+// identify pairs with the sender if it isn't trusted yet, and returns who it
+// is and what it may do
+func (c *Client) identify(conn net.Conn) (*Identity, error) {
+	tofuConn, ok := conn.(*tofu.Conn)
+	if !ok {
+		return nil, tofu.ErrorNoCertificateProvided
+	}
+
+	if err := tofuConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	cs := tofuConn.ConnectionState()
+	if len(cs.PeerCertificates) == 0 {
+		return nil, tofu.ErrorNoCertificateProvided
+	}
+
+	return c.identity(cs.PeerCertificates[0])
+}
+
+// identity is who cert belongs to, a pinned peer's name and permissions only
+// go to the key that was pinned
+func (c *Client) identity(cert *x509.Certificate) (*Identity, error) {
+	from := &Identity{
+		ID:          cert.Subject.CommonName,
+		Fingerprint: tofu.Fingerprint(cert),
+	}
+
+	// Peers a CA vouches for may not be pinned, or pinned to another key
+	entry, err := c.tofu.Entry(from.ID)
+	if errors.Is(err, tofu.ErrorPeerNotTrusted) {
+		return from, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !entry.Pins(from.Fingerprint) {
+		return from, nil
+	}
+
+	from.Name = entry.Name
+	if entry.Permissions != nil {
+		from.Permissions = *entry.Permissions
+	}
+
+	return from, nil
+}
+
+func (c *Client) busy() {
+	if c.active.Add(1) == 1 && c.status != StatusDND {
+		c.broadcaster.SetStatus(StatusBusy)
+	}
+}
+
+func (c *Client) idle() {
+	if c.active.Add(-1) == 0 {
+		c.broadcaster.SetStatus(c.status)
+	}
+}
+
 func Continue(txt string) bool {
 	var confirm bool
 
@@ -236,17 +638,41 @@ func Continue(txt string) bool {
 	return confirm
 }
 
-func OnNewPeer(id, fingerprint string) bool {
-	confirm := false
+func newPeerTitle(id, fingerprint, code string) string {
+	return warningStyle.Render(fmt.Sprintf("The authenticity of peer '%s' can't be established.\nCertificate fingerprint is\n%s\n\nPairing code: %s\n\nOnly trust this peer if it shows the same code.\nDo the codes match?", id, fingerprint, code))
+}
 
-	title := warningStyle.Render(fmt.Sprintf("The authenticity of peer '%s' can't be established.\nCertificate fingerprint is\n%s\nDo you trust this peer?", id, fingerprint))
+func OnNewPeer(id, fingerprint, code string) bool {
+	return ConfirmPrompt(context.Background(), newPeerTitle(id, fingerprint, code))
+}
 
-	huh.NewConfirm().
-		Title(title).
-		Affirmative("Yes").
-		Negative("No").
-		Value(&confirm).
-		Run()
+func showCodeMessage(id, code string) string {
+	return warningStyle.Render(fmt.Sprintf("Peer '%s' is pairing with us, confirm it shows the code: %s", id, code))
+}
 
-	return confirm
+func OnShowCode(id, code string) {
+	fmt.Println(showCodeMessage(id, code))
+}
+
+func keyChangedWarning(id, known, presented string) string {
+	warning := fmt.Sprintf(`WARNING: PEER IDENTIFICATION HAS CHANGED!
+
+The key of peer '%s' is not the one you trusted before.
+Someone could be impersonating it, or it was reinstalled.
+
+Trusted fingerprint:
+%s
+Presented fingerprint:
+%s
+
+The connection was refused. If you verified the new key with the
+peer's owner, re-pin it with:
+
+gobyte trust replace %s %s`, id, known, presented, id, presented)
+
+	return dangerStyle.Render(warning)
+}
+
+func OnKeyChanged(id, known, presented string) {
+	fmt.Println(keyChangedWarning(id, known, presented))
 }
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedCert is a certificate for a new key with CN id, signed by a new CA
+func signedCert(t *testing.T, id string) *x509.Certificate {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func TestIdentityOnlyForPinnedKey(t *testing.T) {
+	c := &Client{tofu: &tofu.Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}}
+
+	pinned := signedCert(t, "friend")
+	require.NoError(t, c.tofu.Add("friend", tofu.Fingerprint(pinned)))
+	require.NoError(t, c.tofu.Rename("friend", "Jane's laptop"))
+	require.NoError(t, c.tofu.SetPermissions("friend", tofu.Permissions{AutoAccept: true}))
+
+	from, err := c.identity(pinned)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane's laptop", from.Name)
+	assert.True(t, from.Permissions.AutoAccept)
+
+	// A CA vouching for another key with the same CN gets nothing of it
+	from, err = c.identity(signedCert(t, "friend"))
+	require.NoError(t, err)
+	assert.Equal(t, "friend", from.ID)
+	assert.Empty(t, from.Name)
+	assert.Equal(t, tofu.Permissions{}, from.Permissions)
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// IdleTimeout bounds the wait for the next message
+	IdleTimeout = time.Minute
+	// StallTimeout bounds each read and write in the middle of a message, a
+	// peer that vanishes mid-file is given up on after it
+	StallTimeout = time.Second * 30
+	// PingInterval is how often a receiver pings the sender while its user
+	// decides on a request, it must stay well under IdleTimeout
+	PingInterval = time.Second * 10
+)
+
+// timeoutConn sets a deadline before every read and write, so a peer that
+// stops responding can't block us forever.
+type timeoutConn struct {
+	net.Conn
+	// the next read starts a message and may wait up to IdleTimeout
+	idle bool
+
+	// guards interrupted and setting deadlines
+	mu sync.Mutex
+	// reads and writes fail right away until resumed, see interruptOnDone
+	interrupted bool
+}
+
+func newTimeoutConn(conn net.Conn) *timeoutConn {
+	return &timeoutConn{Conn: conn, idle: true}
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	timeout := StallTimeout
+	if c.idle {
+		timeout, c.idle = IdleTimeout, false
+	}
+
+	if err := c.deadline(c.Conn.SetReadDeadline, timeout); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.deadline(c.Conn.SetWriteDeadline, StallTimeout); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timeoutConn) deadline(set func(time.Time) error, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.interrupted {
+		return os.ErrDeadlineExceeded
+	}
+	return set(time.Now().Add(timeout))
+}
+
+// idle marks the next read from r as the start of a message, if r is a
+// timeoutConn
+func idle(r io.Reader) {
+	if c, ok := r.(*timeoutConn); ok {
+		c.idle = true
+	}
+}
+
+// interruptOnDone unblocks reads and writes of rw once ctx is done, if rw is
+// a timeoutConn, so the cancel can be sent. The returned func stops it.
+func interruptOnDone(ctx context.Context, rw io.ReadWriter) func() bool {
+	c, ok := rw.(*timeoutConn)
+	if !ok {
+		return func() bool { return false }
+	}
+
+	return context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.interrupted = true
+		c.Conn.SetDeadline(time.Now())
+	})
+}
+
+// resume lets rw be read and written again after interruptOnDone
+func resume(rw io.ReadWriter) {
+	if c, ok := rw.(*timeoutConn); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.interrupted = false
+	}
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTimeouts shortens the connection timeouts for a test
+func setTimeouts(t *testing.T, idle, stall, ping time.Duration) {
+	t.Helper()
+
+	oldIdle, oldStall, oldPing := IdleTimeout, StallTimeout, PingInterval
+	IdleTimeout, StallTimeout, PingInterval = idle, stall, ping
+	t.Cleanup(func() {
+		IdleTimeout, StallTimeout, PingInterval = oldIdle, oldStall, oldPing
+	})
+}
+
+// receiveTimeout starts r on one end of a pipe whose reads and writes time
+// out, and returns the other end
+func receiveTimeout(t *testing.T, r *Receiver, from *Identity) (net.Conn, <-chan error) {
+	t.Helper()
+
+	sender, receiver := net.Pipe()
+	t.Cleanup(func() { receiver.Close() })
+
+	done := make(chan error, 1)
+	go func() {
+		defer sender.Close()
+		done <- r.receive(context.Background(), newTimeoutConn(sender), from)
+	}()
+
+	return receiver, done
+}
+
+func waitErr(t *testing.T, done <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second * 5):
+		t.Fatal("receiver never gave up")
+		return nil
+	}
+}
+
+func TestReceiverIdleTimeout(t *testing.T) {
+	setTimeouts(t, time.Millisecond*50, time.Second, time.Second)
+
+	_, done := receiveTimeout(t, NewReceiver(t.TempDir()), nil)
+	assert.ErrorIs(t, waitErr(t, done), os.ErrDeadlineExceeded)
+}
+
+func TestReceiverStallTimeout(t *testing.T) {
+	setTimeouts(t, time.Second, time.Millisecond*50, time.Second)
+
+	from := &Identity{ID: "friend", Permissions: tofu.Permissions{AutoAccept: true}}
+	conn, done := receiveTimeout(t, NewReceiver(t.TempDir()), from)
+
+	files := testFile(t, "a.txt", "notes", "hello")
+	s := NewSender()
+	req := NewRequest(5, 1)
+	require.NoError(t, s.WriteRequest(conn, req))
+	require.NoError(t, s.ReadResponse(conn))
+
+	// Vanish two bytes into the file
+	for _, metadata := range files {
+		require.NoError(t, s.WriteHeader(conn, metadata))
+	}
+	hd, err := s.proto.SerializeHeader(NewHeader(TypeChunk, 5))
+	require.NoError(t, err)
+	_, err = conn.Write(append(hd, "he"...))
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, waitErr(t, done), os.ErrDeadlineExceeded)
+}
+
+func TestReceiverPingsWhilePrompting(t *testing.T) {
+	setTimeouts(t, time.Millisecond*100, time.Millisecond*100, time.Millisecond*20)
+
+	r := NewReceiver(t.TempDir())
+	r.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool {
+		time.Sleep(IdleTimeout * 3)
+		return false
+	}
+
+	conn, done := receiveTimeout(t, r, nil)
+	tc := newTimeoutConn(conn)
+
+	s := NewSender()
+	require.NoError(t, s.WriteRequest(tc, NewRequest(5, 1)))
+	assert.ErrorIs(t, s.ReadResponse(tc), ErrRequestDenied, "pings should keep the sender waiting")
+	assert.NoError(t, waitErr(t, done))
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package core
+
+import "errors"
+
+// freeSpace isn't known here, the preflight is skipped
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
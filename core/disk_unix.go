@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package core
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to us on the file system of dir
+func freeSpace(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(existingDir(dir), &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
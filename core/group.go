@@ -0,0 +1,148 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	groupTagLabel      = "gobyte-group-tag"
+	groupExporterLabel = "EXPORTER-gobyte-group"
+
+	// MaxHelloSize bounds the TypeHello payload, it only carries a group proof
+	MaxHelloSize uint64 = 64
+)
+
+var (
+	ErrGroupDenied = errors.New("peer is not in our group")
+
+	// Signed announcements older than this are treated as replays
+	GroupMessageMaxAge = time.Second * 30
+)
+
+// Group scopes discovery and connections to peers that share a name or secret.
+// Named groups only tag announcements, secret groups authenticate them with an HMAC
+// and never reveal the secret itself.
+type Group struct {
+	Name   string
+	Secret string
+}
+
+func (g *Group) Enabled() bool {
+	return g != nil && (g.Name != "" || g.Secret != "")
+}
+
+// Tag is what announcements carry in their group field.
+func (g *Group) Tag() string {
+	if !g.Enabled() {
+		return ""
+	}
+
+	if g.Secret == "" {
+		return g.Name
+	}
+
+	mac := hmac.New(sha256.New, []byte(g.Secret))
+	mac.Write([]byte(groupTagLabel))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (g *Group) key() []byte {
+	if g.Secret != "" {
+		return []byte(g.Secret)
+	}
+
+	sum := sha256.Sum256([]byte(g.Name))
+	return sum[:]
+}
+
+// Sign tags msg with the group and, for secret groups, authenticates it.
+func (g *Group) Sign(msg *BroadcastMessage) error {
+	msg.Group = g.Tag()
+	msg.MAC = ""
+	msg.Timestamp = 0
+
+	if !g.Enabled() || g.Secret == "" {
+		return nil
+	}
+
+	msg.Timestamp = time.Now().Unix()
+
+	mac, err := g.mac(msg)
+	if err != nil {
+		return err
+	}
+
+	msg.MAC = hex.EncodeToString(mac)
+	return nil
+}
+
+// Accepts reports whether msg belongs to our group, groupless peers only see
+// groupless announcements.
+func (g *Group) Accepts(msg *BroadcastMessage) bool {
+	if msg.Group != g.Tag() {
+		return false
+	}
+
+	if !g.Enabled() || g.Secret == "" {
+		return true
+	}
+
+	sent := time.Unix(msg.Timestamp, 0)
+	if time.Since(sent).Abs() > GroupMessageMaxAge {
+		return false
+	}
+
+	got, err := hex.DecodeString(msg.MAC)
+	if err != nil {
+		return false
+	}
+
+	want, err := g.mac(msg)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(got, want)
+}
+
+// mac covers the whole message except the MAC itself
+func (g *Group) mac(msg *BroadcastMessage) ([]byte, error) {
+	unsigned := *msg
+	unsigned.MAC = ""
+
+	encoded, err := unsigned.Encoded()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, g.key())
+	mac.Write(*encoded)
+	return mac.Sum(nil), nil
+}
+
+// Proof binds group membership to a TLS session, so it can't be replayed on
+// another connection.
+func (g *Group) Proof(cs tls.ConnectionState) ([]byte, error) {
+	ekm, err := cs.ExportKeyingMaterial(groupExporterLabel, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, g.key())
+	mac.Write(ekm)
+	return mac.Sum(nil), nil
+}
+
+func (g *Group) VerifyProof(cs tls.ConnectionState, proof []byte) bool {
+	want, err := g.Proof(cs)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(proof, want)
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupAccepts(t *testing.T) {
+	office := &Group{Name: "office"}
+	secret := &Group{Secret: "hunter2"}
+
+	tests := []struct {
+		name   string
+		sender *Group
+		recv   *Group
+		tamper func(*BroadcastMessage)
+		want   bool
+	}{
+		{name: "no groups", sender: nil, recv: nil, want: true},
+		{name: "same name", sender: office, recv: &Group{Name: "office"}, want: true},
+		{name: "different name", sender: office, recv: &Group{Name: "lab"}, want: false},
+		{name: "grouped sender, groupless receiver", sender: office, recv: nil, want: false},
+		{name: "groupless sender, grouped receiver", sender: nil, recv: office, want: false},
+		{name: "same secret", sender: secret, recv: &Group{Secret: "hunter2"}, want: true},
+		{name: "wrong secret", sender: secret, recv: &Group{Secret: "hunter3"}, want: false},
+		{
+			name:   "tampered data",
+			sender: secret,
+			recv:   secret,
+			tamper: func(m *BroadcastMessage) { m.Data = "10.0.0.66:8080" },
+			want:   false,
+		},
+		{
+			name:   "copied tag without mac",
+			sender: secret,
+			recv:   secret,
+			tamper: func(m *BroadcastMessage) { m.MAC = "" },
+			want:   false,
+		},
+		{
+			name:   "replayed",
+			sender: secret,
+			recv:   secret,
+			tamper: func(m *BroadcastMessage) {
+				m.Timestamp -= int64(GroupMessageMaxAge/time.Second) + 1
+				m.MAC = ""
+				mac, _ := secret.mac(m)
+				m.MAC = hex.EncodeToString(mac)
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &BroadcastMessage{Type: TypeBroadcastMessageHello, Data: "10.0.0.1:8080", Name: "TEST"}
+			require.NoError(t, tt.sender.Sign(msg))
+
+			// Round trip through the wire format
+			encoded, err := msg.Encoded()
+			require.NoError(t, err)
+			parsed, err := encoded.Parse()
+			require.NoError(t, err)
+
+			if tt.tamper != nil {
+				tt.tamper(parsed)
+			}
+
+			assert.Equal(t, tt.want, tt.recv.Accepts(parsed))
+		})
+	}
+
+	assert.NotContains(t, secret.Tag(), "hunter2")
+}
+
+func TestGroupHello(t *testing.T) {
+	tests := []struct {
+		name    string
+		sender  *Group
+		recv    *Group
+		wantErr error
+	}{
+		{name: "same group", sender: &Group{Secret: "hunter2"}, recv: &Group{Secret: "hunter2"}},
+		{name: "other group", sender: &Group{Secret: "hunter3"}, recv: &Group{Secret: "hunter2"}, wantErr: ErrGroupDenied},
+		{name: "named group", sender: &Group{Name: "office"}, recv: &Group{Name: "office"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tlsPipe(t)
+
+			errch := make(chan error, 1)
+			go func() {
+				r := NewReceiver(t.TempDir())
+				errch <- r.ReadGroupHello(server, tt.recv, server.ConnectionState())
+			}()
+
+			s := NewSender()
+			proof, err := tt.sender.Proof(client.ConnectionState())
+			require.NoError(t, err)
+			require.NoError(t, s.WriteHello(client, proof))
+
+			err = s.ReadResponse(client)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, ErrRequestDenied)
+				assert.ErrorIs(t, <-errch, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.NoError(t, <-errch)
+		})
+	}
+}
+
+// tlsPipe returns both ends of a completed TLS handshake
+func tlsPipe(t *testing.T) (*tls.Conn, *tls.Conn) {
+	t.Helper()
+
+	cert := testCert(t)
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	client := tls.Client(c, &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+	server := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAnyClientCert})
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- server.Handshake()
+	}()
+
+	require.NoError(t, client.Handshake())
+	require.NoError(t, <-errch)
+
+	return client, server
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -14,17 +17,23 @@ const (
 	TypeEnd          uint8 = 0x04
 	TypeHello        uint8 = 0x05
 	TypeDenied       uint8 = 0x06
+	TypePing         uint8 = 0x07 // keeps a connection alive, never answered
+	TypeChunk        uint8 = 0x08 // part of a file's content
+	TypeCancel       uint8 = 0x09 // either side gives up, the payload is the reason
 	TypeError        uint8 = 0xFF
 
 	MaxPayloadSize   uint64 = 32 * 1024 * 1024 * 1024 // 32 GB
 	MaxStringLength  uint32 = 4096                    // 4 KB max for paths/names
 	MaxFileNumber    uint32 = 1000000
+	MaxNoteLength    uint32 = 1024 // free text sent along with a request
+	MaxReasonLength  uint32 = 256  // why a transfer was cancelled
+	ChunkSize        uint32 = 64 * 1024
 	HeaderSize       uint8  = 12
 	RequestSize      uint8  = 12
 	FileMetadataSize uint8  = 16
 
-	Version uint8 = 0x11
-	VERSION       = "1.1"
+	Version uint8 = 0x17
+	VERSION       = "1.7"
 )
 
 var (
@@ -39,6 +48,8 @@ var (
 	ErrInvalidLength       = errors.New("invalid length field")
 	ErrInsufficientData    = errors.New("insufficient data for string fields")
 	ErrEmptyString         = errors.New("string field cannot be empty")
+	ErrInvalidNote         = errors.New("note must be UTF-8 text without control characters")
+	ErrInvalidReason       = errors.New("cancel reason must be UTF-8 text without control characters")
 )
 
 // Header represents the protocol header (12 bytes)
@@ -49,10 +60,11 @@ type Header struct {
 	Reserved uint16 // 2 bytes
 }
 
-// Request represents a request message payload (12 bytes)
+// Request represents a request message payload (12 bytes + optional note)
 type Request struct {
 	Size   uint64 // 8 bytes
 	Length uint32 // 4 bytes
+	Note   string // rest of the payload, the header's length covers it (max 1KB)
 }
 
 // FileMetadata represents file metadata payload (16 bytes + variable strings)
@@ -123,7 +135,7 @@ func (p *Proto) SerializeRequest(req *Request) ([]byte, error) {
 		return nil, fmt.Errorf("request validation failed: %w", err)
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, RequestSize))
+	buf := bytes.NewBuffer(make([]byte, 0, int(RequestSize)+len(req.Note)))
 
 	if err := binary.Write(buf, binary.BigEndian, req.Size); err != nil {
 		return nil, fmt.Errorf("failed to write size: %w", err)
@@ -131,11 +143,15 @@ func (p *Proto) SerializeRequest(req *Request) ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, req.Length); err != nil {
 		return nil, fmt.Errorf("failed to write length: %w", err)
 	}
+	if _, err := buf.WriteString(req.Note); err != nil {
+		return nil, fmt.Errorf("failed to write note: %w", err)
+	}
 
 	return buf.Bytes(), nil
 }
 
-// DeserializeRequest deserializes bytes to a request
+// DeserializeRequest deserializes bytes to a request, anything after the
+// fixed fields is the note
 func (p *Proto) DeserializeRequest(data []byte) (*Request, error) {
 	if len(data) < int(RequestSize) {
 		return nil, ErrInvalidRequestSize
@@ -144,9 +160,13 @@ func (p *Proto) DeserializeRequest(data []byte) (*Request, error) {
 	reader := bytes.NewReader(data[:RequestSize])
 	var req Request
 
-	if err := binary.Read(reader, binary.BigEndian, &req); err != nil {
-		return nil, fmt.Errorf("failed to read request: %w", err)
+	if err := binary.Read(reader, binary.BigEndian, &req.Size); err != nil {
+		return nil, fmt.Errorf("failed to read size: %w", err)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &req.Length); err != nil {
+		return nil, fmt.Errorf("failed to read length: %w", err)
 	}
+	req.Note = string(data[RequestSize:])
 
 	if err := p.validateRequest(&req); err != nil {
 		return nil, fmt.Errorf("request validation failed: %w", err)
@@ -236,13 +256,26 @@ func (p *Proto) validateHeader(header *Header) error {
 		return ErrPayloadTooLarge
 	}
 
-	switch header.Type {
-	case TypeRequest, TypeFileMetadata, TypeAck, TypeEnd, TypeError:
-		// Valid types
-	default:
+	if !p.IsValidType(header.Type) {
 		return ErrInvalidType
 	}
 
+	if header.Type == TypeHello && header.Length > MaxHelloSize {
+		return ErrPayloadTooLarge
+	}
+
+	if header.Type == TypePing && header.Length != 0 {
+		return ErrPayloadTooLarge
+	}
+
+	if header.Type == TypeChunk && header.Length > uint64(ChunkSize) {
+		return ErrPayloadTooLarge
+	}
+
+	if header.Type == TypeCancel && header.Length > uint64(MaxReasonLength) {
+		return ErrPayloadTooLarge
+	}
+
 	if header.Reserved != 0 {
 		return ErrReservedFieldUsed
 	}
@@ -259,9 +292,42 @@ func (p *Proto) validateRequest(req *Request) error {
 		return ErrInvalidLength
 	}
 
+	return ValidateNote(req.Note)
+}
+
+// ValidateNote checks a request's note, it is shown on the receiver's
+// terminal so control characters are refused.
+func ValidateNote(note string) error {
+	if uint32(len(note)) > MaxNoteLength {
+		return ErrStringTooLong
+	}
+
+	if !isText(note) {
+		return ErrInvalidNote
+	}
+
+	return nil
+}
+
+// ValidateReason checks why a transfer was cancelled, it is shown on the
+// other side just like a note.
+func ValidateReason(reason string) error {
+	if uint32(len(reason)) > MaxReasonLength {
+		return ErrStringTooLong
+	}
+
+	if !isText(reason) {
+		return ErrInvalidReason
+	}
+
 	return nil
 }
 
+// isText reports whether s is safe to print to a terminal
+func isText(s string) bool {
+	return utf8.ValidString(s) && strings.IndexFunc(s, unicode.IsControl) < 0
+}
+
 func (p *Proto) validateFileMetadata(fm *FileMetadata) error {
 	if fm.LengthName == 0 || len(fm.Name) == 0 {
 		return ErrEmptyString
@@ -289,7 +355,7 @@ func (p *Proto) validateFileMetadata(fm *FileMetadata) error {
 
 func (p *Proto) IsValidType(msgType uint8) bool {
 	switch msgType {
-	case TypeRequest, TypeFileMetadata, TypeAck, TypeEnd, TypeError:
+	case TypeRequest, TypeFileMetadata, TypeAck, TypeEnd, TypeHello, TypeDenied, TypePing, TypeChunk, TypeCancel, TypeError:
 		return true
 	default:
 		return false
@@ -2,6 +2,7 @@ package core
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -265,6 +266,44 @@ func TestRequestSerializeDeserialize(t *testing.T) {
 	}
 }
 
+func TestRequestNote(t *testing.T) {
+	p := NewProto()
+
+	req := NewRequest(2048, 2)
+	req.Note = "build logs for #123 ✓"
+
+	serialized, err := p.SerializeRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, int(RequestSize)+len(req.Note), len(serialized))
+
+	deserialized, err := p.DeserializeRequest(serialized)
+	require.NoError(t, err)
+	assert.Equal(t, req, deserialized)
+
+	tests := []struct {
+		name string
+		note string
+		err  error
+	}{
+		{name: "too long", note: strings.Repeat("a", int(MaxNoteLength)+1), err: ErrStringTooLong},
+		{name: "escape sequence", note: "\x1b[2Jhi", err: ErrInvalidNote},
+		{name: "newline", note: "two\nlines", err: ErrInvalidNote},
+		{name: "invalid utf-8", note: "\xff", err: ErrInvalidNote},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.SerializeRequest(&Request{Size: 1, Length: 1, Note: tt.note})
+			assert.ErrorIs(t, err, tt.err)
+
+			data := append(make([]byte, RequestSize), tt.note...)
+			data[RequestSize-1] = 1
+			_, err = p.DeserializeRequest(data)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
 func TestRequestDeserializeInvalidData(t *testing.T) {
 	p := NewProto()
 
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+)
+
+const (
+	SourceDiscovered = "discovered"
+	SourceStatic     = "static"
+	SourceCache      = "cache"
+)
+
+var (
+	ErrInvalidStaticPeer = errors.New("invalid static peer, expected name=host:port")
+
+	ProbeInterval = time.Second * 5
+	ProbeTimeout  = time.Second
+	// Cached peers not seen for this long are forgotten
+	PeerCacheTTL = time.Hour * 24 * 30
+)
+
+// ParseStaticPeer parses a name=host:port peer definition.
+func ParseStaticPeer(s string) (*Peer, error) {
+	name, addr, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok {
+		return nil, ErrInvalidStaticPeer
+	}
+
+	name = strings.TrimSpace(name)
+	addr = strings.TrimSpace(addr)
+	if name == "" || addr == "" {
+		return nil, ErrInvalidStaticPeer
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidStaticPeer, s)
+	}
+
+	return &Peer{
+		Name:   name,
+		Data:   addr,
+		Source: SourceStatic,
+	}, nil
+}
+
+// LoadStaticPeers reads name=host:port lines from path, blank lines and
+// lines starting with # are skipped. A missing file is not an error.
+func LoadStaticPeers(path string) ([]*Peer, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var peers []*Peer
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p, err := ParseStaticPeer(line)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+
+	return peers, scanner.Err()
+}
+
+type CachedPeer struct {
+	Name     string    `json:"name"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// PeerCache remembers the last address of peers we have transferred to,
+// so they can be offered again when broadcasts don't get through.
+type PeerCache struct {
+	path string
+
+	mu    sync.Mutex
+	peers map[string]*CachedPeer
+}
+
+func LoadPeerCache(path string) (*PeerCache, error) {
+	c := &PeerCache{
+		path:  path,
+		peers: make(map[string]*CachedPeer),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []*CachedPeer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to read peer cache: %w", err)
+	}
+
+	for _, p := range peers {
+		if time.Since(p.LastSeen) > PeerCacheTTL {
+			continue
+		}
+		c.peers[p.Name] = p
+	}
+
+	return c, nil
+}
+
+func (c *PeerCache) Peers() []CachedPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peers := make([]CachedPeer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, *p)
+	}
+	return peers
+}
+
+// Remember records a peer we successfully connected to and saves the cache.
+func (c *PeerCache) Remember(name, addr string) error {
+	c.mu.Lock()
+	c.peers[name] = &CachedPeer{
+		Name:     name,
+		Addr:     addr,
+		LastSeen: time.Now(),
+	}
+	c.mu.Unlock()
+
+	return c.Save()
+}
+
+func (c *PeerCache) Save() error {
+	c.mu.Lock()
+	peers := make([]*CachedPeer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	data, err := json.MarshalIndent(peers, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return tofu.WriteFileAtomic(c.path, data, 0600)
+}
+
+// probe reports whether something accepts TCP connections at addr.
+func probe(ctx context.Context, addr string) bool {
+	dialer := net.Dialer{Timeout: ProbeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Probe checks static and cached peers every ProbeInterval. Reachable peers
+// are refreshed in the broadcaster, cached peers only show up once reachable.
+func (b *Broadcaster) Probe(ctx context.Context, cache *PeerCache) {
+	ticker := time.NewTicker(ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		var candidates []Peer
+
+		b.mu.Lock()
+		for _, p := range b.peers {
+			if p.Source == SourceStatic {
+				candidates = append(candidates, *p)
+			}
+		}
+		b.mu.Unlock()
+
+		if cache != nil {
+			for _, cp := range cache.Peers() {
+				candidates = append(candidates, Peer{Name: cp.Name, Data: cp.Addr, Source: SourceCache})
+			}
+		}
+
+		var wg sync.WaitGroup
+		for _, p := range candidates {
+			wg.Add(1)
+			go func(p Peer) {
+				defer wg.Done()
+				if probe(ctx, p.Data) {
+					b.touch(p)
+				}
+			}(p)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AddStaticPeer adds a manually configured peer, static peers never expire.
+func (b *Broadcaster) AddStaticPeer(p *Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sp := *p
+	sp.Source = SourceStatic
+	b.peers[sp.Name] = &sp
+	b.emit(PeerJoined, &sp)
+}
+
+// touch marks a probed peer as alive, discovered peers already have fresher info
+func (b *Broadcaster) touch(p Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Held to the same checks as announced peers, without an announcement
+	// to prove it a probed peer is never in our group
+	msg := &BroadcastMessage{Name: p.Name}
+	msg.Fingerprint = p.Presence.Fingerprint
+	if !b.admits(msg) {
+		return
+	}
+
+	existing, ok := b.peers[p.Name]
+	if !ok {
+		p.LastHello = time.Now()
+		b.peers[p.Name] = &p
+		b.emit(PeerJoined, &p)
+		return
+	}
+
+	if existing.Source == SourceDiscovered {
+		return
+	}
+
+	existing.LastHello = time.Now()
+	b.emit(PeerUpdated, existing)
+}
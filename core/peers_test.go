@@ -0,0 +1,209 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStaticPeer(t *testing.T) {
+	tests := []struct {
+		name    string
+		def     string
+		want    *Peer
+		wantErr bool
+	}{
+		{
+			name: "ip and port",
+			def:  "desktop=192.168.1.20:8080",
+			want: &Peer{Name: "desktop", Data: "192.168.1.20:8080", Source: SourceStatic},
+		},
+		{
+			name: "hostname with spaces",
+			def:  " nas = nas.local:8080 ",
+			want: &Peer{Name: "nas", Data: "nas.local:8080", Source: SourceStatic},
+		},
+		{
+			name:    "missing name",
+			def:     "=192.168.1.20:8080",
+			wantErr: true,
+		},
+		{
+			name:    "missing port",
+			def:     "desktop=192.168.1.20",
+			wantErr: true,
+		},
+		{
+			name:    "missing separator",
+			def:     "192.168.1.20:8080",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseStaticPeer(tt.def)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidStaticPeer)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, p)
+		})
+	}
+}
+
+func TestLoadStaticPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+
+	peers, err := LoadStaticPeers(path)
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+
+	content := "# office\ndesktop=192.168.1.20:8080\n\nnas=nas.local:8080\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	peers, err = LoadStaticPeers(path)
+	require.NoError(t, err)
+	require.Len(t, peers, 2)
+	assert.Equal(t, "desktop", peers[0].Name)
+	assert.Equal(t, "nas.local:8080", peers[1].Data)
+}
+
+func TestPeerCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peercache.json")
+
+	cache, err := LoadPeerCache(path)
+	require.NoError(t, err)
+	assert.Empty(t, cache.Peers())
+
+	require.NoError(t, cache.Remember("desktop", "192.168.1.20:8080"))
+
+	loaded, err := LoadPeerCache(path)
+	require.NoError(t, err)
+
+	peers := loaded.Peers()
+	require.Len(t, peers, 1)
+	assert.Equal(t, "desktop", peers[0].Name)
+	assert.Equal(t, "192.168.1.20:8080", peers[0].Addr)
+
+	loaded.peers["desktop"].LastSeen = time.Now().Add(-PeerCacheTTL - time.Hour)
+	require.NoError(t, loaded.Save())
+
+	expired, err := LoadPeerCache(path)
+	require.NoError(t, err)
+	assert.Empty(t, expired.Peers())
+}
+
+func TestStaticPeersNeverExpire(t *testing.T) {
+	b := NewBroadcaster(":8090", ":42069")
+
+	p, err := ParseStaticPeer("desktop=192.168.1.20:8080")
+	require.NoError(t, err)
+
+	b.AddStaticPeer(p)
+	b.expire()
+	b.remove("desktop", nil)
+
+	peers := b.GetPeers()
+	require.Contains(t, peers, "desktop")
+	assert.Equal(t, SourceStatic, peers["desktop"].Source)
+
+	// A hello from the same peer refreshes it but keeps it static
+	b.record(&BroadcastMessage{Type: TypeBroadcastMessageHello, Data: "192.168.1.21:8080", Name: "desktop"}, nil)
+
+	peers = b.GetPeers()
+	assert.Equal(t, SourceStatic, peers["desktop"].Source)
+	assert.Equal(t, "192.168.1.21:8080", peers["desktop"].Data)
+}
+
+func TestProbeCachedPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cache, err := LoadPeerCache(filepath.Join(t.TempDir(), "peercache.json"))
+	require.NoError(t, err)
+	require.NoError(t, cache.Remember("alive", ln.Addr().String()))
+	require.NoError(t, cache.Remember("dead", "127.0.0.1:1"))
+
+	b := NewBroadcaster(":8091", ":42069")
+	go b.Probe(t.Context(), cache)
+
+	var peers map[string]*Peer
+	for range 20 {
+		time.Sleep(time.Millisecond * 50)
+		peers = b.GetPeers()
+		if len(peers) > 0 {
+			break
+		}
+	}
+
+	require.Contains(t, peers, "alive")
+	assert.Equal(t, SourceCache, peers["alive"].Source)
+	assert.NotContains(t, peers, "dead")
+}
+
+func TestProbeIsQuiet(t *testing.T) {
+	c := &Client{
+		tofu:     &tofu.Tofu{ID: "receiver", Dir: t.TempDir()},
+		receiver: NewReceiver(t.TempDir()),
+	}
+	require.NoError(t, c.tofu.Init())
+
+	ln, err := c.tofu.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.listen(ctx, ln) }()
+
+	assert.True(t, probe(ctx, ln.Addr().String()))
+	time.Sleep(time.Millisecond * 100)
+
+	cancel()
+	<-done
+	assert.Empty(t, logs.String(), "a probe was logged")
+}
+
+func TestProbedPeersFiltered(t *testing.T) {
+	b := NewReceiveOnlyBroadcaster(":42069")
+	b.SetBlocked(func(name, fingerprint string) bool {
+		return name == "nuisance"
+	})
+
+	b.touch(Peer{Name: "nuisance", Data: "192.168.1.20:8080", Source: SourceCache})
+	b.touch(Peer{Name: "friend", Data: "192.168.1.21:8080", Source: SourceCache})
+
+	peers := b.GetPeers()
+	assert.NotContains(t, peers, "nuisance", "a blocked peer was probed into the list")
+	assert.Contains(t, peers, "friend")
+
+	// Nothing proves a probed peer is in our group
+	b.SetGroup(&Group{Name: "team", Secret: "hunter2"})
+	b.touch(Peer{Name: "stranger", Data: "192.168.1.22:8080", Source: SourceCache})
+	assert.NotContains(t, b.GetPeers(), "stranger")
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/huh"
@@ -13,48 +14,81 @@ const (
 	PAGESIZE = 25
 )
 
-var SamplePeers = map[string]*peer{
+var SamplePeers = map[string]*Peer{
 	"test": {
-		name:      "test",
-		data:      ":8080",
-		lastHello: time.Now(),
+		Name:      "test",
+		Data:      ":8080",
+		LastHello: time.Now(),
 	},
 }
 
 type PeerSelector struct {
 	selected string
-	peers    map[string]*peer
-	Selected map[string]*peer
-	filter   string
-	page     int
-	sortBy   string
+	Selected map[string]*Peer
+
+	// peers is updated from the broadcaster's event stream while the form runs
+	mu    sync.Mutex
+	peers map[string]*Peer
+
+	filter string
+	page   int
+	sortBy string
 }
 
-func NewPeerSelector(peers map[string]*peer) *PeerSelector {
+func NewPeerSelector(peers map[string]*Peer) *PeerSelector {
 	if peers == nil {
-		peers = make(map[string]*peer)
+		peers = make(map[string]*Peer)
 	}
 	return &PeerSelector{
 		peers:    peers,
-		Selected: make(map[string]*peer),
+		Selected: make(map[string]*Peer),
 		page:     0,
 		sortBy:   "name",
 	}
 }
 
-func (p *PeerSelector) filteredPeers() []*peer {
-	var peerList []*peer
+// Apply updates the selector's peers from a broadcaster event, safe to call
+// while the form is running.
+func (p *PeerSelector) Apply(ev PeerEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch ev.Type {
+	case PeerJoined, PeerUpdated:
+		peer := ev.Peer
+		p.peers[peer.Name] = &peer
+	case PeerLeft:
+		delete(p.peers, ev.Peer.Name)
+	}
+}
+
+// Follow applies events until the channel is closed.
+func (p *PeerSelector) Follow(events <-chan PeerEvent) {
+	for ev := range events {
+		p.Apply(ev)
+	}
+}
+
+func (p *PeerSelector) filteredPeers() []*Peer {
+	var peerList []*Peer
 
+	p.mu.Lock()
 	for _, peer := range p.peers {
+		// Senders, do-not-disturb and incompatible peers can't take a transfer
+		if !peer.CanAccept() {
+			continue
+		}
 		peerList = append(peerList, peer)
 	}
+	p.mu.Unlock()
 
 	if p.filter != "" {
-		filtered := make([]*peer, 0)
+		filtered := make([]*Peer, 0)
 		filterLower := strings.ToLower(p.filter)
 		for _, peer := range peerList {
-			if strings.Contains(strings.ToLower(peer.name), filterLower) ||
-				strings.Contains(strings.ToLower(peer.data), filterLower) {
+			if strings.Contains(strings.ToLower(peer.Name), filterLower) ||
+				strings.Contains(strings.ToLower(peer.Presence.DisplayName), filterLower) ||
+				strings.Contains(strings.ToLower(peer.Data), filterLower) {
 				filtered = append(filtered, peer)
 			}
 		}
@@ -64,58 +98,90 @@ func (p *PeerSelector) filteredPeers() []*peer {
 	sort.Slice(peerList, func(i, j int) bool {
 		switch p.sortBy {
 		case "data":
-			return peerList[i].data < peerList[j].data
+			return peerList[i].Data < peerList[j].Data
 		case "lastseen":
-			return peerList[i].lastHello.After(peerList[j].lastHello)
+			return peerList[i].LastHello.After(peerList[j].LastHello)
 		default:
-			return strings.ToLower(peerList[i].name) < strings.ToLower(peerList[j].name)
+			return strings.ToLower(peerList[i].Name) < strings.ToLower(peerList[j].Name)
 		}
 	})
 
 	return peerList
 }
 
-func (p *PeerSelector) formatPeerOption(peer *peer) string {
-	name := peer.name
+func (p *PeerSelector) formatPeerOption(peer *Peer) string {
+	name := peer.DisplayName()
 	if len(name) > 20 {
 		name = name[:17] + "..."
 	}
 
-	data := peer.data
+	data := peer.Data
 	if len(data) > 25 {
 		data = data[:22] + "..."
 	}
 
+	status := peer.Presence.Status
+	if status == "" {
+		status = "-"
+	}
+
+	system := peer.Presence.OS
+	if system == "" {
+		system = "-"
+	}
+
+	version := "-"
+	if peer.Presence.Proto != 0 {
+		version = protoString(peer.Presence.Proto)
+	}
+
+	features := strings.Join(peer.Presence.Features, ",")
+	if len(features) > 20 {
+		features = features[:17] + "..."
+	}
+
 	lastSeenStr := ""
 	elapsed := 0
-	if !peer.lastHello.IsZero() {
-		elapsed = int(time.Since(peer.lastHello).Seconds())
+	if !peer.LastHello.IsZero() {
+		elapsed = int(time.Since(peer.LastHello).Seconds())
 		lastSeenStr = fmt.Sprintf("%ds", elapsed)
 	}
 
-	peerKey := peer.name
+	peerKey := peer.Name
 	selectedPrefix := ""
 	if _, isSelected := p.Selected[peerKey]; isSelected {
 		selectedPrefix = selectedStyle.Render("✓ ")
 	}
 
-	text := fmt.Sprintf("%s%-20s %-25s %s",
+	text := fmt.Sprintf("%s%-20s %-25s %-9s %-8s %-4s %-20s %-5s",
 		selectedPrefix,
 		name,
 		data,
+		status,
+		system,
+		version,
+		features,
 		lastSeenStr,
 	)
 
-	if time.Since(peer.lastHello) > HelloInterval {
+	if peer.Source == SourceStatic || peer.Source == SourceCache {
+		text += " " + peer.Source
+	}
+
+	if time.Since(peer.LastHello) > HelloInterval || peer.Presence.Status == StatusBusy {
 		text = warningStyle.Render(text)
 	}
 
 	return text
 }
 
+// protoString renders a protocol version byte, 0x11 becomes 1.1
+func protoString(v uint8) string {
+	return fmt.Sprintf("%d.%d", v>>4, v&0x0F)
+}
+
 func (p *PeerSelector) RunRecur() error {
-	// Peers will update automatically, since we are using the map pointer
-	// from the broadcaster, beautiful
+	// Peers are kept up to date by Apply, refreshing just re-renders them
 	peers := p.filteredPeers()
 
 	totalItems := len(peers)
@@ -156,7 +222,7 @@ func (p *PeerSelector) RunRecur() error {
 	for i := start; i < end; i++ {
 		peer := peers[i]
 		displayText := p.formatPeerOption(peer)
-		options = append(options, huh.NewOption(displayText, peer.name))
+		options = append(options, huh.NewOption(displayText, peer.Name))
 	}
 
 	options = append(options,
@@ -226,7 +292,9 @@ func (p *PeerSelector) Filter() error {
 }
 
 func (p *PeerSelector) TogglePeer(peerName string) {
+	p.mu.Lock()
 	peer, exists := p.peers[peerName]
+	p.mu.Unlock()
 	if !exists {
 		return
 	}
@@ -241,27 +309,27 @@ func (p *PeerSelector) TogglePeer(peerName string) {
 func (p *PeerSelector) SelectAll() error {
 	filteredPeers := p.filteredPeers()
 	for _, peer := range filteredPeers {
-		if _, ok := p.Selected[peer.name]; ok {
-			delete(p.Selected, peer.name)
+		if _, ok := p.Selected[peer.Name]; ok {
+			delete(p.Selected, peer.Name)
 		} else {
-			p.Selected[peer.name] = peer
+			p.Selected[peer.Name] = peer
 		}
 	}
 	return p.RunRecur()
 }
 
 func (p *PeerSelector) ClearSelection() {
-	p.Selected = make(map[string]*peer)
+	p.Selected = make(map[string]*Peer)
 }
 
-func (p *PeerSelector) GetSelectedPeers() []*peer {
-	peers := make([]*peer, 0, len(p.Selected))
+func (p *PeerSelector) GetSelectedPeers() []*Peer {
+	peers := make([]*Peer, 0, len(p.Selected))
 	for _, peer := range p.Selected {
 		peers = append(peers, peer)
 	}
 
 	sort.Slice(peers, func(i, j int) bool {
-		return strings.ToLower(peers[i].name) < strings.ToLower(peers[j].name)
+		return strings.ToLower(peers[i].Name) < strings.ToLower(peers[j].Name)
 	})
 
 	return peers
@@ -276,7 +344,10 @@ func (p *PeerSelector) GetSelectedNames() []string {
 	return names
 }
 
-func (p *PeerSelector) UpdatePeers(peers map[string]*peer) {
+func (p *PeerSelector) UpdatePeers(peers map[string]*Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.peers = peers
 	for name := range p.Selected {
 		if _, exists := p.peers[name]; !exists {
@@ -286,5 +357,8 @@ func (p *PeerSelector) UpdatePeers(peers map[string]*peer) {
 }
 
 func (p *PeerSelector) GetTotalCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	return len(p.peers)
 }
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+)
+
+// DefaultProfile is the profile used without --profile, it keeps the
+// hostname as its ID so peers that paired before profiles still trust it.
+const DefaultProfile = "default"
+
+const profileFile = "profile.json"
+
+var (
+	ErrInvalidProfile  = errors.New("invalid profile name, expected letters, digits, '-' or '_'")
+	ErrProfileNotFound = errors.New("profile not found")
+	ErrProfileExists   = errors.New("profile already exists")
+)
+
+var validProfileName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Profile is one identity of ours: its own key, trust database, peers file
+// and the defaults of the flags that set where files go and who we announce
+// ourselves as.
+type Profile struct {
+	Name        string `json:"-"`
+	DisplayName string `json:"display_name,omitempty"`
+	// Dir is where received files go and files are picked from
+	Dir   string `json:"dir,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	path string
+}
+
+// ProfilesDir holds one directory per profile.
+func ProfilesDir() (string, error) {
+	dir, err := tofu.DefaultDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "profiles"), nil
+}
+
+func profilePath(name string) (string, error) {
+	if !validProfileName.MatchString(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidProfile, name)
+	}
+
+	dir, err := ProfilesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// LoadProfile reads a profile, the default one is created on first use and
+// takes over ~/gobyte from before profiles existed.
+func LoadProfile(name string) (*Profile, error) {
+	path, err := profilePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{Name: name, path: path}
+
+	if name == DefaultProfile {
+		if err := migrateLegacyDir(path); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(path, profileFile))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("%w: %s", ErrProfileNotFound, name)
+			}
+			return nil, err
+		}
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to read profile %s: %w", name, err)
+	}
+
+	return p, nil
+}
+
+// CreateProfile makes a new profile, its key is created the first time it
+// is used.
+func CreateProfile(p *Profile) error {
+	path, err := profilePath(p.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(path, 0700); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %s", ErrProfileExists, p.Name)
+		}
+		return err
+	}
+
+	p.path = path
+	return p.Save()
+}
+
+// RemoveProfile deletes a profile with its key and trusted peers.
+func RemoveProfile(name string) error {
+	path, err := profilePath(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrProfileNotFound, name)
+		}
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
+
+// Profiles lists the names of every profile, the default one included once
+// it has been used.
+func Profiles() ([]string, error) {
+	dir, err := ProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && validProfileName.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Save writes the profile's settings.
+func (p *Profile) Save() error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return tofu.WriteFileAtomic(filepath.Join(p.path, profileFile), data, 0600)
+}
+
+// Path is the profile's directory, it is tofu.Tofu.Dir.
+func (p *Profile) Path() string {
+	return p.path
+}
+
+// ID is the tofu ID of the profile, the hostname for the default profile
+// and name@hostname for the others.
+func (p *Profile) ID() string {
+	if p.Name == DefaultProfile {
+		return Hostname()
+	}
+	return p.Name + "@" + Hostname()
+}
+
+// legacyFiles are what ~/gobyte held before profiles, received files stay
+var legacyFiles = []string{"cert", "trust.json", "trust", "peers", "peercache.json"}
+
+// migrateLegacyDir moves ~/gobyte into the default profile the first time it
+// is loaded.
+func migrateLegacyDir(path string) error {
+	return tofu.MigrateLegacyDir(path, legacyFiles...)
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tempHome points the home and config directories somewhere disposable
+func tempHome(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	return home
+}
+
+func TestProfiles(t *testing.T) {
+	tempHome(t)
+
+	_, err := LoadProfile("work")
+	assert.ErrorIs(t, err, ErrProfileNotFound)
+
+	for _, name := range []string{"", "../work", "a b", "work@host"} {
+		assert.ErrorIs(t, CreateProfile(&Profile{Name: name}), ErrInvalidProfile, name)
+	}
+
+	require.NoError(t, CreateProfile(&Profile{Name: "work", DisplayName: "Work laptop", Group: "team"}))
+	assert.ErrorIs(t, CreateProfile(&Profile{Name: "work"}), ErrProfileExists)
+
+	work, err := LoadProfile("work")
+	require.NoError(t, err)
+	assert.Equal(t, "Work laptop", work.DisplayName)
+	assert.Equal(t, "team", work.Group)
+	assert.Equal(t, "work@"+Hostname(), work.ID())
+
+	def, err := LoadProfile(DefaultProfile)
+	require.NoError(t, err)
+	assert.Equal(t, Hostname(), def.ID(), "the default profile keeps the hostname")
+	assert.NotEqual(t, work.Path(), def.Path())
+
+	names, err := Profiles()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{DefaultProfile, "work"}, names)
+
+	require.NoError(t, RemoveProfile("work"))
+	assert.ErrorIs(t, RemoveProfile("work"), ErrProfileNotFound)
+}
+
+func TestMigrateLegacyDir(t *testing.T) {
+	home := tempHome(t)
+
+	legacy := filepath.Join(home, "gobyte")
+	require.NoError(t, os.MkdirAll(filepath.Join(legacy, "cert"), 0700))
+	require.NoError(t, os.MkdirAll(filepath.Join(legacy, "received"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(legacy, "cert", "host.key"), []byte("key"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(legacy, "trust.json"), []byte("{}"), 0600))
+
+	p, err := LoadProfile(DefaultProfile)
+	require.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(p.Path(), "cert", "host.key"))
+	assert.FileExists(t, filepath.Join(p.Path(), "trust.json"))
+	assert.NoFileExists(t, filepath.Join(legacy, "trust.json"))
+	assert.DirExists(t, filepath.Join(legacy, "received"), "received files stay where they are")
+
+	// Only the first load migrates
+	require.NoError(t, os.WriteFile(filepath.Join(legacy, "trust.json"), []byte("{}"), 0600))
+	_, err = LoadProfile(DefaultProfile)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(legacy, "trust.json"))
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/huh"
+)
+
+// Prompter asks a yes or no question, it must give up and return false once
+// ctx is done.
+type Prompter func(ctx context.Context, title string) bool
+
+// PromptBroker shows prompts one at a time in the order they were asked, so
+// concurrent connections don't draw over each other, and denies the ones
+// nobody answers in time.
+type PromptBroker struct {
+	// Timeout denies a prompt not answered this long after it was asked,
+	// time spent waiting in the queue included. 0 waits forever.
+	Timeout time.Duration
+
+	prompt Prompter
+	// holds a token while a prompt or message owns the terminal, waiting
+	// senders are served in order
+	turn    chan struct{}
+	waiting atomic.Int32
+}
+
+func NewPromptBroker(prompt Prompter) *PromptBroker {
+	return &PromptBroker{
+		prompt: prompt,
+		turn:   make(chan struct{}, 1),
+	}
+}
+
+// Confirm queues a question and blocks until it is answered, false if it
+// timed out or ctx was done first.
+func (b *PromptBroker) Confirm(ctx context.Context, title string) bool {
+	parent := ctx
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+
+	b.waiting.Add(1)
+	defer b.waiting.Add(-1)
+
+	select {
+	case b.turn <- struct{}{}:
+	case <-ctx.Done():
+		if parent.Err() == nil {
+			log.Printf("[warn] Denied a prompt still queued after %s", b.Timeout)
+		}
+		return false
+	}
+	defer func() { <-b.turn }()
+
+	// Our turn and the timeout can come at once
+	if ctx.Err() != nil {
+		if parent.Err() == nil {
+			log.Printf("[warn] Denied a prompt still queued after %s", b.Timeout)
+		}
+		return false
+	}
+
+	// Ourselves excluded
+	if n := b.waiting.Load() - 1; n > 0 {
+		title = fmt.Sprintf("%s\n\n(%d more waiting)", title, n)
+	}
+
+	if !b.prompt(ctx, title) {
+		if ctx.Err() != nil && parent.Err() == nil {
+			log.Printf("[warn] Denied a prompt left unanswered for %s", b.Timeout)
+		}
+		return false
+	}
+
+	return true
+}
+
+// Print shows a message once no prompt is open, without waiting for it.
+func (b *PromptBroker) Print(msg string) {
+	go func() {
+		b.turn <- struct{}{}
+		defer func() { <-b.turn }()
+
+		fmt.Println(msg)
+	}()
+}
+
+// ConfirmPrompt is the Prompter asking on the terminal.
+func ConfirmPrompt(ctx context.Context, title string) bool {
+	confirm := false
+
+	err := huh.NewForm(huh.NewGroup(
+		huh.NewConfirm().
+			Title(title).
+			Affirmative("Yes").
+			Negative("No").
+			Value(&confirm),
+	)).RunWithContext(ctx)
+
+	return err == nil && confirm
+}
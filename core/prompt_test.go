@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromptBrokerOneAtATime(t *testing.T) {
+	var open, most atomic.Int32
+	titles := make(chan string, 3)
+	release := make(chan bool)
+
+	b := NewPromptBroker(func(ctx context.Context, title string) bool {
+		n := open.Add(1)
+		defer open.Add(-1)
+		if n > most.Load() {
+			most.Store(n)
+		}
+
+		titles <- title
+		return <-release
+	})
+
+	var wg sync.WaitGroup
+	answers := make(chan bool, 3)
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answers <- b.Confirm(context.Background(), "Accept?")
+		}()
+	}
+
+	// The first one is shown once all three are queued
+	require.Eventually(t, func() bool { return b.waiting.Load() == 3 }, time.Second, time.Millisecond)
+	<-titles
+	release <- true
+
+	assert.Equal(t, "Accept?\n\n(1 more waiting)", <-titles)
+	release <- false
+	assert.Equal(t, "Accept?", <-titles)
+	release <- true
+
+	wg.Wait()
+	close(answers)
+
+	var accepted int
+	for a := range answers {
+		if a {
+			accepted++
+		}
+	}
+
+	assert.Equal(t, 2, accepted)
+	assert.Equal(t, int32(1), most.Load(), "prompts overlapped")
+}
+
+func TestPromptBrokerTimeout(t *testing.T) {
+	// Nobody answers
+	b := NewPromptBroker(func(ctx context.Context, title string) bool {
+		<-ctx.Done()
+		return false
+	})
+	b.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	assert.False(t, b.Confirm(context.Background(), "Trust?"))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The first prompt keeps the terminal, the second times out queued
+	shown := make(chan string, 2)
+	release := make(chan struct{})
+	b = NewPromptBroker(func(ctx context.Context, title string) bool {
+		shown <- title
+		<-release
+		return true
+	})
+	b.Timeout = 50 * time.Millisecond
+
+	first := make(chan bool)
+	go func() { first <- b.Confirm(context.Background(), "First?") }()
+	assert.Equal(t, "First?", <-shown)
+
+	assert.False(t, b.Confirm(context.Background(), "Second?"))
+	assert.Empty(t, shown, "a queued prompt was shown after its timeout")
+
+	close(release)
+	<-first
+}
+
+func TestPromptBrokerCancel(t *testing.T) {
+	b := NewPromptBroker(func(ctx context.Context, title string) bool {
+		<-ctx.Done()
+		return false
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	answer := make(chan bool)
+	go func() { answer <- b.Confirm(ctx, "Accept?") }()
+	cancel()
+
+	select {
+	case ok := <-answer:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("the prompt outlived its connection")
+	}
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+	ErrInsufficientSpace = errors.New("not enough free disk space")
+	ErrRequestExceeded   = errors.New("sender exceeded its request")
+)
+
+// Limits a QuotaError can be about
+const (
+	LimitTransfer = "transfer"
+	LimitDaily    = "daily"
+	LimitInbox    = "inbox"
+	LimitDisk     = "disk"
+)
+
+// Quota limits what a receiver accepts from everyone, on top of each peer's
+// tofu.Permissions. Zero fields are unlimited.
+type Quota struct {
+	// MaxTransferBytes caps a single transfer
+	MaxTransferBytes uint64
+	// MaxPeerDailyBytes caps what one peer sends in a day, counted since the
+	// receiver started
+	MaxPeerDailyBytes uint64
+	// MaxInboxBytes caps everything in the receive directory
+	MaxInboxBytes uint64
+}
+
+// QuotaError is why a request was denied before it was acked, it matches
+// ErrInsufficientSpace for LimitDisk and ErrQuotaExceeded otherwise.
+type QuotaError struct {
+	Limit     string
+	Available uint64
+	Requested uint64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: %s requested, %s left (%s)",
+		e.Unwrap(), humanize.Bytes(e.Requested), humanize.Bytes(e.Available), e.Limit)
+}
+
+func (e *QuotaError) Unwrap() error {
+	if e.Limit == LimitDisk {
+		return ErrInsufficientSpace
+	}
+	return ErrQuotaExceeded
+}
+
+// RequestExceededError aborts a transfer as soon as the sender sends more
+// bytes or files than its request declared, it matches ErrRequestExceeded.
+type RequestExceededError struct {
+	What     string // "bytes" or "files"
+	Declared uint64
+	Sent     uint64
+}
+
+func (e *RequestExceededError) Error() string {
+	return fmt.Sprintf("%v: declared %d %s, sent at least %d", ErrRequestExceeded, e.Declared, e.What, e.Sent)
+}
+
+func (e *RequestExceededError) Unwrap() error {
+	return ErrRequestExceeded
+}
+
+// usage is what a peer sent today and what its transfers in progress may
+// still send
+type usage struct {
+	day      string
+	received uint64
+	reserved uint64
+}
+
+// quotas keeps the running totals Quota is checked against
+type quotas struct {
+	mu      sync.Mutex
+	peers   map[string]*usage
+	pending uint64 // reserved by transfers in progress, for the inbox
+}
+
+func (q *quotas) usage(peerID string) *usage {
+	if q.peers == nil {
+		q.peers = make(map[string]*usage)
+	}
+
+	u, ok := q.peers[peerID]
+	if !ok {
+		u = &usage{}
+		q.peers[peerID] = u
+	}
+
+	if today := time.Now().Format(time.DateOnly); u.day != today {
+		u.day = today
+		u.received = 0
+	}
+
+	return u
+}
+
+// reserve checks a request against quota and the free space in dir, and
+// holds its size until release
+func (q *quotas) reserve(quota Quota, dir, peerID string, size uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if quota.MaxTransferBytes > 0 && size > quota.MaxTransferBytes {
+		return &QuotaError{Limit: LimitTransfer, Available: quota.MaxTransferBytes, Requested: size}
+	}
+
+	u := q.usage(peerID)
+	if quota.MaxPeerDailyBytes > 0 {
+		if used := u.received + u.reserved; used+size > quota.MaxPeerDailyBytes {
+			return &QuotaError{Limit: LimitDaily, Available: sub(quota.MaxPeerDailyBytes, used), Requested: size}
+		}
+	}
+
+	if quota.MaxInboxBytes > 0 {
+		inbox, err := dirSize(dir)
+		if err != nil {
+			return err
+		}
+
+		if used := inbox + q.pending; used+size > quota.MaxInboxBytes {
+			return &QuotaError{Limit: LimitInbox, Available: sub(quota.MaxInboxBytes, used), Requested: size}
+		}
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	if err == nil && q.pending+size > free {
+		return &QuotaError{Limit: LimitDisk, Available: sub(free, q.pending), Requested: size}
+	}
+
+	u.reserved += size
+	q.pending += size
+
+	return nil
+}
+
+// release gives back what is left of a reservation, the bytes that never
+// arrived
+func (q *quotas) release(peerID string, size uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usage(peerID)
+	u.reserved -= size
+	q.pending -= size
+}
+
+// received counts n bytes a peer sent toward its daily total, they are no
+// longer reserved and the inbox has them on disk
+func (q *quotas) received(peerID string, n uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usage(peerID)
+	u.received += n
+	u.reserved -= n
+	q.pending -= n
+}
+
+func sub(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// dirSize sums the size of the files under dir, a missing dir is empty
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// existingDir is dir or its closest parent that exists, the receive
+// directory is only created on the first transfer
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
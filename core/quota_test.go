@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotas(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old.bin"), make([]byte, 600), 0644))
+
+	var q quotas
+	quota := Quota{MaxTransferBytes: 500, MaxPeerDailyBytes: 700, MaxInboxBytes: 1500}
+
+	var qerr *QuotaError
+	err := q.reserve(quota, dir, "a", 501)
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, LimitTransfer, qerr.Limit)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// Reserved and received bytes both count toward the day
+	require.NoError(t, q.reserve(quota, dir, "a", 400))
+	err = q.reserve(quota, dir, "a", 400)
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, LimitDaily, qerr.Limit)
+	assert.Equal(t, uint64(300), qerr.Available)
+
+	// Arriving bytes move from reserved to received, not counted twice
+	q.received("a", 100)
+	err = q.reserve(quota, dir, "a", 300)
+	require.NoError(t, err)
+	q.release("a", 300)
+
+	q.received("a", 300)
+	q.release("a", 0)
+	err = q.reserve(quota, dir, "a", 301)
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, LimitDaily, qerr.Limit)
+
+	// Other peers have their own day, but share the inbox with what's on disk
+	require.NoError(t, q.reserve(quota, dir, "b", 500))
+	err = q.reserve(quota, dir, "c", 401)
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, LimitInbox, qerr.Limit)
+	assert.Equal(t, uint64(400), qerr.Available)
+	q.release("b", 500)
+
+	// More than any disk has
+	if _, err := freeSpace(dir); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("free space isn't known on this platform")
+	}
+	err = q.reserve(Quota{}, filepath.Join(dir, "not", "created", "yet"), "a", math.MaxUint64/2)
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, LimitDisk, qerr.Limit)
+	assert.ErrorIs(t, err, ErrInsufficientSpace)
+}
+
+func TestReceiverQuota(t *testing.T) {
+	r := NewReceiver(t.TempDir())
+	r.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool { return true }
+	r.Quota = Quota{MaxTransferBytes: 10}
+
+	from := &Identity{ID: "friend"}
+
+	sendErr, err := sendFiles(t, r, from, testFile(t, "a.txt", "notes", "more than ten bytes"), 19)
+	assert.ErrorIs(t, sendErr, ErrRequestDenied)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// Sending more than the request declared
+	var rerr *RequestExceededError
+	_, err = sendFiles(t, r, from, testFile(t, "b.txt", "notes", "hello"), 4)
+	require.ErrorAs(t, err, &rerr)
+	assert.Equal(t, "bytes", rerr.What)
+
+	files := testFile(t, "c.txt", "notes", "hello")
+	for abs, metadata := range testFile(t, "d.txt", "notes", "hello") {
+		files[abs] = metadata
+	}
+
+	sender, receiver := net.Pipe()
+	defer receiver.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer sender.Close()
+		done <- r.receive(context.Background(), sender, from)
+	}()
+
+	s := NewSender()
+	req := NewRequest(10, 1)
+	require.NoError(t, s.WriteRequest(receiver, req))
+	require.NoError(t, s.ReadResponse(receiver))
+	s.Send(context.Background(), receiver, files, req)
+	receiver.Close()
+
+	err = <-done
+	require.ErrorAs(t, err, &rerr)
+	assert.Equal(t, "files", rerr.What)
+	assert.ErrorIs(t, err, ErrRequestExceeded)
+}
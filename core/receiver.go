@@ -2,19 +2,44 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
-	"github.com/charmbracelet/huh"
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/dustin/go-humanize"
 )
 
+var (
+	ErrNotPermitted = errors.New("not permitted")
+	ErrUnsafePath   = errors.New("unsafe path")
+)
+
+// Identity is who sent a transfer, as verified during the TLS handshake.
+type Identity struct {
+	ID          string
+	Fingerprint string
+	// Name is what we call the peer in the trust database, if anything
+	Name        string
+	Permissions tofu.Permissions
+}
+
 type Receiver struct {
-	dir       string
-	proto     *Proto
-	OnRequest func(req *Request) bool
+	dir   string
+	proto *Proto
+	// OnRequest decides on a request, it must give up once ctx is done
+	OnRequest func(ctx context.Context, req *Request, from *Identity) bool
+	// Quota is checked before a request is acked, along with the free space
+	Quota  Quota
+	quotas quotas
 }
 
 func NewReceiver(dir string) *Receiver {
@@ -25,14 +50,41 @@ func NewReceiver(dir string) *Receiver {
 	}
 }
 
-func (r *Receiver) receive(rdw io.ReadWriter) error {
-	counter := 1
+// receive handles one connection, from is nil for senders we know nothing
+// about and is held to the zero Permissions. Messages the connection's state
+// doesn't allow are answered with TypeError and end it. Once ctx is done the
+// transfer is cancelled, and the sender told why.
+func (r *Receiver) receive(ctx context.Context, rdw io.ReadWriter, from *Identity) error {
+	if from == nil {
+		from = &Identity{}
+	}
+
+	m := NewStateMachine()
+
+	stop := interruptOnDone(ctx, rdw)
+	defer stop()
+
+	err := r.serve(ctx, rdw, m, from)
+	if ctx.Err() == nil || m.State() == StateEnded {
+		return err
+	}
+
+	return r.cancel(ctx, rdw, m)
+}
+
+func (r *Receiver) serve(ctx context.Context, rdw io.ReadWriter, m *StateMachine, from *Identity) error {
+	t := &transfer{}
 
-	req := &Request{}
 	for {
+		idle(rdw)
+
 		buf := make([]byte, HeaderSize)
 		_, err := io.ReadFull(rdw, buf)
 		if err != nil {
+			// Hanging up mid-transfer isn't the end of it
+			if err == io.EOF && m.InTransfer() {
+				return io.ErrUnexpectedEOF
+			}
 			if err == io.EOF {
 				return nil
 			}
@@ -41,40 +93,367 @@ func (r *Receiver) receive(rdw io.ReadWriter) error {
 
 		hd, err := r.proto.DeserializeHeader(buf)
 		if err != nil {
+			r.WriteResponse(rdw, TypeError)
+			return err
+		}
+
+		if err := m.Next(hd.Type); err != nil {
+			r.WriteResponse(rdw, TypeError)
 			return err
 		}
 
 		switch hd.Type {
+		case TypeHello:
+			// Group membership is checked before we get here, a receiver
+			// without a group accepts anyone
+			_, err := r.ReadHello(rdw, hd)
+			if err != nil {
+				return err
+			}
+
+			err = r.respond(rdw, m, TypeAck)
+			if err != nil {
+				return err
+			}
+
 		case TypeRequest:
-			var err error
-			req, err = r.ReadRequest(rdw)
+			req, err := r.ReadRequest(rdw, hd)
 			if err != nil {
 				return err
 			}
 
-			ok := r.OnRequest(req)
-			if !ok {
-				err = r.WriteResponse(rdw, TypeDenied)
+			// Over a quota or without the space for it is denied without asking
+			if err := r.quotas.reserve(r.Quota, r.dir, from.ID, req.Size); err != nil {
+				r.respond(rdw, m, TypeDenied)
 				return err
 			}
+			defer func() { r.quotas.release(from.ID, req.Size-t.arrived) }()
+
+			// Too large for the peer is denied without asking
+			ok := from.Permissions.AllowsSize(req.Size)
+			if ok && !from.Permissions.AutoAccept {
+				ok, err = r.ask(ctx, rdw, m, req, from)
+				if errors.Is(err, ErrProtocolViolation) {
+					r.WriteResponse(rdw, TypeError)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !ok {
+				return r.respond(rdw, m, TypeDenied)
+			}
 
-			err = r.WriteResponse(rdw, TypeAck)
+			t.req = req
+			err = r.respond(rdw, m, TypeAck)
 			if err != nil {
 				return err
 			}
 
-			err = r.ReadFiles(rdw, req, &counter)
+		case TypeFileMetadata:
+			err := r.ReadFile(ctx, rdw, m, t, from)
+			if errors.Is(err, ErrProtocolViolation) {
+				r.WriteResponse(rdw, TypeError)
+				return err
+			}
+			if refused := refusal(err); refused != nil {
+				return r.refuse(rdw, m, err, refused)
+			}
 			if err != nil {
 				return err
 			}
 
-		default:
+		case TypeChunk:
+			// Chunks are read along with their file, one here is more than
+			// the file's size
 			r.WriteResponse(rdw, TypeError)
+			return &ProtocolError{State: m.State(), Type: hd.Type}
+
+		case TypeEnd:
+			// The sender hangs up next, anything else is a violation
+
+		case TypePing:
+
+		case TypeCancel:
+			return readCancel(rdw, hd)
+
+		case TypeError:
+			return ErrRemoteError
+		}
+	}
+}
+
+// refusal is the sentinel of a file we refused to take, nil if err isn't one
+func refusal(err error) error {
+	for _, target := range []error{ErrRequestExceeded, ErrNotPermitted, ErrUnsafePath} {
+		if errors.Is(err, target) {
+			return target
+		}
+	}
+	return nil
+}
+
+// refuse cancels the transfer over a file we won't take, telling the sender
+// why. Details that don't fit in a reason are left out.
+func (r *Receiver) refuse(rw io.ReadWriter, m *StateMachine, err, refused error) error {
+	m.Next(TypeCancel)
+
+	reason := err.Error()
+	if ValidateReason(reason) != nil {
+		reason = refused.Error()
+	}
+	if werr := writeCancel(r.proto, rw, reason); werr != nil {
+		return err
+	}
+	drain(rw)
+
+	return err
+}
+
+// cancel tells the sender we gave up on the transfer because ctx is done
+func (r *Receiver) cancel(ctx context.Context, rw io.ReadWriter, m *StateMachine) error {
+	resume(rw)
+	m.Next(TypeCancel)
+
+	reason := cancelReason(ctx)
+	if err := writeCancel(r.proto, rw, reason); err != nil {
+		return err
+	}
+	drain(rw)
+
+	return &CancelError{Reason: reason}
+}
+
+// ask runs OnRequest, pinging the sender meanwhile so it doesn't take a user
+// thinking it over for a dead connection. The prompt is given up on if the
+// sender cancels or hangs up while it is open.
+func (r *Receiver) ask(ctx context.Context, rdw io.ReadWriter, m *StateMachine, req *Request, from *Identity) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the pings and what the sender sends both move m
+	var mu sync.Mutex
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(PingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				err := r.respond(rdw, m, TypePing)
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	w := watchSender(rdw, r.proto, func(hd *Header) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return m.Next(hd.Type)
+	}, cancel)
+
+	answer := make(chan bool, 1)
+	go func() {
+		answer <- r.OnRequest(ctx, req, from)
+	}()
+
+	var ok bool
+	select {
+	case ok = <-answer:
+	case <-ctx.Done():
+	}
+
+	close(stop)
+	<-done
+
+	if err := w.stop(); err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// senderWatch reads from the sender while its request is prompted for,
+// through the connection under any timeoutConn so a user may take longer
+// than IdleTimeout.
+type senderWatch struct {
+	conn  net.Conn
+	proto *Proto
+	err   chan error
+
+	// guards stopped and the read deadline, a message that started arriving
+	// is read in full even if stop comes meanwhile
+	mu      sync.Mutex
+	stopped bool
+}
+
+// watchSender reads what the sender sends until stopped, next checks each
+// message and cancel is called if the sender cancels, hangs up or misbehaves.
+// Readers without deadlines aren't watched.
+func watchSender(rw io.ReadWriter, p *Proto, next func(*Header) error, cancel func()) *senderWatch {
+	w := &senderWatch{proto: p, err: make(chan error, 1)}
+	switch c := rw.(type) {
+	case *timeoutConn:
+		w.conn = c.Conn
+	case net.Conn:
+		w.conn = c
+	default:
+		w.err <- nil
+		return w
+	}
+
+	go func() {
+		err := w.watch(next)
+		if err != nil {
+			cancel()
+		}
+		w.err <- err
+	}()
+
+	return w
+}
+
+func (w *senderWatch) watch(next func(*Header) error) error {
+	for {
+		w.mu.Lock()
+		if w.stopped {
+			w.mu.Unlock()
 			return nil
 		}
+		w.conn.SetReadDeadline(time.Time{})
+		w.mu.Unlock()
+
+		buf := make([]byte, HeaderSize)
+		n, err := w.conn.Read(buf[:1])
+		if n == 0 {
+			if w.isStopped() {
+				return nil
+			}
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		w.mu.Lock()
+		w.conn.SetReadDeadline(time.Now().Add(StallTimeout))
+		w.mu.Unlock()
+
+		if _, err := io.ReadFull(w.conn, buf[1:]); err != nil {
+			return err
+		}
+
+		hd, err := w.proto.DeserializeHeader(buf)
+		if err != nil {
+			return err
+		}
+
+		if err := next(hd); err != nil {
+			return err
+		}
+
+		switch hd.Type {
+		case TypeCancel:
+			return readCancel(w.conn, hd)
+		case TypeError:
+			return ErrRemoteError
+		}
 	}
 }
 
+func (w *senderWatch) isStopped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.stopped
+}
+
+// stop unblocks and waits for the watch, and returns the sender's
+// *CancelError or why the connection failed, if anything.
+func (w *senderWatch) stop() error {
+	if w.conn == nil {
+		return <-w.err
+	}
+
+	w.mu.Lock()
+	w.stopped = true
+	w.conn.SetReadDeadline(time.Now())
+	w.mu.Unlock()
+
+	err := <-w.err
+	w.conn.SetReadDeadline(time.Time{})
+
+	return err
+}
+
+// respond answers the sender, if the connection's state allows it
+func (r *Receiver) respond(w io.Writer, m *StateMachine, msgType uint8) error {
+	if err := m.Next(msgType); err != nil {
+		return err
+	}
+	return r.WriteResponse(w, msgType)
+}
+
+// ReadHello reads a TypeHello payload, the header must already be consumed.
+func (r *Receiver) ReadHello(rd io.Reader, hd *Header) ([]byte, error) {
+	buf := make([]byte, hd.Length)
+	_, err := io.ReadFull(rd, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// ReadGroupHello requires the next message to be a TypeHello carrying a valid
+// proof for group, and answers it with an ack or a denial.
+func (r *Receiver) ReadGroupHello(rdw io.ReadWriter, group *Group, cs tls.ConnectionState) error {
+	idle(rdw)
+
+	buf := make([]byte, HeaderSize)
+	_, err := io.ReadFull(rdw, buf)
+	if err != nil {
+		return err
+	}
+
+	hd, err := r.proto.DeserializeHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	if hd.Type != TypeHello {
+		r.WriteResponse(rdw, TypeDenied)
+		return ErrGroupDenied
+	}
+
+	proof, err := r.ReadHello(rdw, hd)
+	if err != nil {
+		return err
+	}
+
+	if !group.VerifyProof(cs, proof) {
+		r.WriteResponse(rdw, TypeDenied)
+		return ErrGroupDenied
+	}
+
+	return r.WriteResponse(rdw, TypeAck)
+}
+
 func (r *Receiver) WriteResponse(w io.Writer, msgType uint8) error {
 	header := NewHeader(msgType, 0)
 	serializedheader, err := r.proto.SerializeHeader(header)
@@ -86,44 +465,126 @@ func (r *Receiver) WriteResponse(w io.Writer, msgType uint8) error {
 	return err
 }
 
-func (r *Receiver) ReadFiles(rd io.Reader, req *Request, counter *int) error {
-	for {
+// transfer is what the sender declared and sent so far
+type transfer struct {
+	req      *Request
+	received uint64
+	// arrived is what was actually read of received, no longer reserved
+	arrived uint64
+}
+
+// ReadFile reads the current file of a transfer, its metadata header must
+// already be consumed.
+func (r *Receiver) ReadFile(ctx context.Context, rd io.Reader, m *StateMachine, t *transfer, from *Identity) error {
+	metadata, err := r.ReadFileMetadata(rd)
+	if err != nil {
+		return err
+	}
+
+	// The request's size is only what the sender claims
+	t.received += metadata.Size
+	if !from.Permissions.AllowsSize(t.received) {
+		return fmt.Errorf("%w: more than %d bytes", ErrNotPermitted, from.Permissions.MaxBytes)
+	}
+	if t.received > t.req.Size {
+		return &RequestExceededError{What: "bytes", Declared: t.req.Size, Sent: t.received}
+	}
+	if m.File() > t.req.Length {
+		return &RequestExceededError{What: "files", Declared: uint64(t.req.Length), Sent: uint64(m.File())}
+	}
+
+	arrived := func(n uint64) {
+		t.arrived += n
+		r.quotas.received(from.ID, n)
+	}
+
+	content := &chunkReader{ctx: ctx, proto: r.proto, rd: rd, m: m, remaining: metadata.Size, arrived: arrived}
+	_, err = r.Write(content, metadata, from, t.req, int(m.File()))
+	return err
+}
+
+// chunkReader reads a file's content out of the chunks it is sent in
+type chunkReader struct {
+	ctx   context.Context
+	proto *Proto
+	rd    io.Reader
+	m     *StateMachine
+	// left of the current chunk, and of the file after it
+	left      uint64
+	remaining uint64
+	// arrived is told about every byte read
+	arrived func(n uint64)
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	for c.left == 0 {
 		buf := make([]byte, HeaderSize)
-		_, err := io.ReadFull(rd, buf)
+		_, err := io.ReadFull(c.rd, buf)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
+			return 0, err
 		}
 
-		hd, err := r.proto.DeserializeHeader(buf)
+		hd, err := c.proto.DeserializeHeader(buf)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		switch hd.Type {
-		case TypeFileMetadata:
-			metadata, err := r.ReadFileMetadata(rd)
-			if err != nil {
-				return err
-			}
+		if err := c.m.Next(hd.Type); err != nil {
+			return 0, err
+		}
 
-			_, err = r.Write(rd, metadata, req, *counter)
-			if err != nil {
-				return err
+		switch hd.Type {
+		case TypeChunk:
+			if hd.Length == 0 || hd.Length > c.remaining {
+				return 0, &ProtocolError{State: c.m.State(), Type: hd.Type}
 			}
+			c.left = hd.Length
+			c.remaining -= hd.Length
+		case TypePing:
+		case TypeCancel:
+			return 0, readCancel(c.rd, hd)
+		case TypeError:
+			return 0, ErrRemoteError
+		default:
+			// The next file or the end before this one is complete
+			return 0, &ProtocolError{State: StateTransferring, Type: hd.Type}
+		}
+	}
 
-			*counter++
+	if uint64(len(b)) > c.left {
+		b = b[:c.left]
+	}
 
-		case TypeEnd:
-			return nil
-		}
+	n, err := c.rd.Read(b)
+	c.left -= uint64(n)
+	if n > 0 && c.arrived != nil {
+		c.arrived(uint64(n))
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
+
+	return n, err
 }
 
-func (r *Receiver) ReadRequest(rd io.Reader) (*Request, error) {
-	buf := make([]byte, RequestSize)
+// ReadRequest reads a TypeRequest payload and its note, the header must
+// already be consumed.
+func (r *Receiver) ReadRequest(rd io.Reader, hd *Header) (*Request, error) {
+	if hd.Length < uint64(RequestSize) {
+		return nil, ErrInvalidRequestSize
+	}
+	if hd.Length > uint64(RequestSize)+uint64(MaxNoteLength) {
+		return nil, ErrStringTooLong
+	}
+
+	buf := make([]byte, hd.Length)
 
 	_, err := io.ReadFull(rd, buf)
 	if err != nil {
@@ -181,25 +642,60 @@ func (r *Receiver) ReadFileMetadata(rd io.Reader) (*FileMetadata, error) {
 	return metadata, nil
 }
 
-func (r *Receiver) Write(rd io.Reader, metadata *FileMetadata, req *Request, counter int) (int64, error) {
-	dir := filepath.Join(r.dir, metadata.Path)
+// safeJoin joins elem to base, refusing results outside of base. Absolute
+// elements are taken as relative to base, like filepath.Join does.
+func safeJoin(base string, elem ...string) (string, error) {
+	path := filepath.Join(append([]string{base}, elem...)...)
+
+	rel, err := filepath.Rel(base, path)
+	if err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, filepath.Join(elem...))
+	}
+
+	return path, nil
+}
+
+func (r *Receiver) Write(rd io.Reader, metadata *FileMetadata, from *Identity, req *Request, counter int) (int64, error) {
+	if metadata.Name != filepath.Base(metadata.Name) || metadata.Name == "." || metadata.Name == ".." {
+		return 0, fmt.Errorf("%w: %s", ErrUnsafePath, metadata.Name)
+	}
+
+	if !from.Permissions.AllowsType(metadata.Name) {
+		return 0, fmt.Errorf("%w: file type of %s", ErrNotPermitted, metadata.Name)
+	}
+
+	dest, err := safeJoin(r.dir, from.Permissions.Subdir)
+	if err != nil {
+		return 0, err
+	}
+
+	dir, err := safeJoin(dest, metadata.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	rel, _ := filepath.Rel(dest, dir)
+	if !from.Permissions.AllowsDir(rel) {
+		return 0, fmt.Errorf("%w: directory %s", ErrNotPermitted, rel)
+	}
+
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return 0, err
 	}
 
-	filePath := filepath.Join(r.dir, metadata.Path, metadata.Name)
+	filePath := filepath.Join(dir, metadata.Name)
 
-	_, err := os.Stat(filePath)
+	_, err = os.Stat(filePath)
 	if err == nil {
 		ext := filepath.Ext(metadata.Name)
 		nameWithoutExt := (metadata.Name)[:len(metadata.Name)-len(ext)]
 		var c int
-		c, err = countSameFileNamePrefix(metadata.Path, nameWithoutExt, ext)
+		c, err = countSameFileNamePrefix(dir, nameWithoutExt, ext)
 		if err != nil {
 			return 0, err
 		}
 
-		filePath = filepath.Join(r.dir, metadata.Path, fmt.Sprintf("%s (%d)%s", nameWithoutExt, c+1, ext))
+		filePath = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", nameWithoutExt, c+1, ext))
 	}
 
 	file, err := os.Create(filePath)
@@ -212,6 +708,12 @@ func (r *Receiver) Write(rd io.Reader, metadata *FileMetadata, req *Request, cou
 	bar := DefaultBar(int64(metadata.Size), text)
 
 	n, err := io.CopyN(io.MultiWriter(file, bar), rd, int64(metadata.Size))
+	if err != nil {
+		// Nothing resumes a partial file, don't leave it behind
+		file.Close()
+		os.Remove(filePath)
+	}
+
 	return n, err
 }
 
@@ -224,17 +726,26 @@ func countSameFileNamePrefix(dir, prefix, ext string) (int, error) {
 	return len(matches), nil
 }
 
-func OnRequest(req *Request) bool {
-	confirm := false
+func requestTitle(req *Request, from *Identity) string {
+	sender := "an unknown peer"
+	switch {
+	case from.Name != "":
+		sender = fmt.Sprintf("'%s' (%s)", from.Name, from.ID)
+	case from.ID != "":
+		sender = fmt.Sprintf("'%s'", from.ID)
+	}
 
-	title := fmt.Sprintf("Accept %d files? (%d Bytes) \n", req.Length, req.Size)
+	title := fmt.Sprintf("Accept %d files (%s) from %s?", req.Length, humanize.Bytes(req.Size), sender)
+	if from.Fingerprint != "" {
+		title += "\nFingerprint: " + from.Fingerprint
+	}
+	if req.Note != "" {
+		title += "\n\nNote: " + req.Note
+	}
 
-	huh.NewConfirm().
-		Title(title).
-		Affirmative("Yes").
-		Negative("No").
-		Value(&confirm).
-		Run()
+	return title + "\n"
+}
 
-	return confirm
+func OnRequest(ctx context.Context, req *Request, from *Identity) bool {
+	return ConfirmPrompt(ctx, requestTitle(req, from))
 }
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeJoin(t *testing.T) {
+	base := t.TempDir()
+
+	for _, ok := range []string{"a", "a/b", ".", "", "/abs/is/relative", "a/../b"} {
+		path, err := safeJoin(base, ok)
+		assert.NoError(t, err, ok)
+		assert.True(t, strings.HasPrefix(path, base), ok)
+	}
+
+	for _, bad := range []string{"..", "../x", "a/../../x"} {
+		_, err := safeJoin(base, bad)
+		assert.ErrorIs(t, err, ErrUnsafePath, bad)
+	}
+}
+
+// sendFiles sends files to a receiver with from's permissions and returns
+// what the receiver returned
+func sendFiles(t *testing.T, r *Receiver, from *Identity, files map[string]*FileMetadata, size uint64) (error, error) {
+	t.Helper()
+	return sendFilesWithNote(t, r, from, files, size, "")
+}
+
+func sendFilesWithNote(t *testing.T, r *Receiver, from *Identity, files map[string]*FileMetadata, size uint64, note string) (error, error) {
+	t.Helper()
+
+	sender, receiver := net.Pipe()
+	defer receiver.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer sender.Close()
+		done <- r.receive(context.Background(), sender, from)
+	}()
+
+	s := NewSender()
+	req := NewRequest(size, uint32(len(files)))
+	req.Note = note
+	require.NoError(t, s.WriteRequest(receiver, req))
+
+	err := s.ReadResponse(receiver)
+	if err == nil {
+		err = s.Send(context.Background(), receiver, files, req)
+	}
+	if err == nil {
+		err = s.WriteEnd(receiver)
+	}
+	receiver.Close()
+
+	return err, <-done
+}
+
+func testFile(t *testing.T, name, path string, content string) map[string]*FileMetadata {
+	t.Helper()
+
+	abs := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(abs, []byte(content), 0644))
+
+	return map[string]*FileMetadata{abs: {
+		Size:       uint64(len(content)),
+		LengthName: uint32(len(name)),
+		LengthPath: uint32(len(path)),
+		Name:       name,
+		Path:       path,
+		AbsPath:    abs,
+	}}
+}
+
+func TestReceiverPermissions(t *testing.T) {
+	dir := t.TempDir()
+	r := NewReceiver(dir)
+
+	prompted := false
+	r.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool {
+		prompted = true
+		return true
+	}
+
+	from := &Identity{ID: "friend", Permissions: tofu.Permissions{
+		AutoAccept:   true,
+		MaxBytes:     10,
+		AllowedTypes: []string{".txt"},
+		Subdir:       "friend",
+		AllowedDirs:  []string{"notes"},
+	}}
+
+	_, err := sendFiles(t, r, from, testFile(t, "a.txt", "notes", "hello"), 5)
+	require.NoError(t, err)
+	assert.False(t, prompted, "expected auto accept to skip the prompt")
+	assert.FileExists(t, filepath.Join(dir, "friend", "notes", "a.txt"))
+
+	_, err = sendFiles(t, r, from, testFile(t, "a.exe", "notes", "hello"), 5)
+	assert.ErrorIs(t, err, ErrNotPermitted, "file type")
+
+	_, err = sendFiles(t, r, from, testFile(t, "a.txt", "elsewhere", "hello"), 5)
+	assert.ErrorIs(t, err, ErrNotPermitted, "directory")
+
+	_, err = sendFiles(t, r, from, testFile(t, "a.txt", "../..", "hello"), 5)
+	assert.ErrorIs(t, err, ErrUnsafePath)
+
+	// Lying about the size doesn't get past MaxBytes
+	_, err = sendFiles(t, r, from, testFile(t, "b.txt", "notes", "more than ten bytes"), 5)
+	assert.ErrorIs(t, err, ErrNotPermitted, "size")
+
+	sendErr, err := sendFiles(t, r, from, testFile(t, "c.txt", "notes", "hello"), 11)
+	assert.ErrorIs(t, sendErr, ErrRequestDenied, "announced size")
+	assert.NoError(t, err)
+	assert.False(t, prompted)
+}
+
+func TestReceiverRefusalReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       map[string]*FileMetadata
+		size       uint64
+		wantReason string
+		wantErr    error
+	}{
+		{
+			name:       "file type",
+			file:       testFile(t, "a.exe", "notes", "hello"),
+			size:       5,
+			wantReason: "not permitted: file type of a.exe",
+			wantErr:    ErrNotPermitted,
+		},
+		{
+			name:       "unsafe path",
+			file:       testFile(t, "a.txt", "../..", "hello"),
+			size:       5,
+			wantReason: "unsafe path: ../..",
+			wantErr:    ErrUnsafePath,
+		},
+		{
+			name:       "more than declared",
+			file:       testFile(t, "a.txt", "notes", "hello"),
+			size:       4,
+			wantReason: "sender exceeded its request: declared 4 bytes, sent at least 5",
+			wantErr:    ErrRequestExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReceiver(t.TempDir())
+			from := &Identity{ID: "friend", Permissions: tofu.Permissions{
+				AutoAccept:   true,
+				AllowedTypes: []string{".txt"},
+			}}
+
+			sender, receiver := net.Pipe()
+			defer receiver.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				defer sender.Close()
+				done <- r.receive(context.Background(), sender, from)
+			}()
+
+			s := NewSender()
+			require.NoError(t, s.WriteRequest(receiver, NewRequest(tt.size, 1)))
+			require.NoError(t, s.ReadResponse(receiver))
+			for _, metadata := range tt.file {
+				require.NoError(t, s.WriteHeader(receiver, metadata))
+			}
+
+			var cerr *CancelError
+			require.ErrorAs(t, s.ReadResponse(receiver), &cerr)
+			assert.True(t, cerr.ByPeer)
+			assert.Equal(t, tt.wantReason, cerr.Reason)
+			receiver.Close()
+
+			assert.ErrorIs(t, <-done, tt.wantErr)
+		})
+	}
+}
+
+func TestRequestPrompt(t *testing.T) {
+	r := NewReceiver(t.TempDir())
+
+	var title string
+	r.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool {
+		title = requestTitle(req, from)
+		return true
+	}
+
+	from := &Identity{ID: "jane-pc", Name: "Jane's laptop", Fingerprint: "ed25519:sha256:abcd"}
+	_, err := sendFilesWithNote(t, r, from, testFile(t, "a.txt", "logs", "hello"), 1500000, "build logs for #123")
+	require.NoError(t, err)
+
+	assert.Contains(t, title, "Accept 1 files (1.5 MB) from 'Jane's laptop' (jane-pc)?")
+	assert.Contains(t, title, "Fingerprint: ed25519:sha256:abcd")
+	assert.Contains(t, title, "Note: build logs for #123")
+
+	assert.Contains(t, requestTitle(NewRequest(5, 1), &Identity{}), "from an unknown peer")
+
+	// Longer than a note can be
+	sender, receiver := net.Pipe()
+	defer receiver.Close()
+
+	go func() {
+		hd, _ := NewProto().SerializeHeader(NewHeader(TypeRequest, uint64(RequestSize)+uint64(MaxNoteLength)+1))
+		receiver.Write(hd)
+	}()
+
+	assert.ErrorIs(t, r.receive(context.Background(), sender, from), ErrStringTooLong)
+}
@@ -1,34 +1,73 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 )
 
+// Sender writes one connection's messages, a new one is needed for each
+// connection.
 type Sender struct {
 	proto *Proto
+	state *StateMachine
 }
 
 func NewSender() *Sender {
 	return &Sender{
-		NewProto(),
+		proto: NewProto(),
+		state: NewStateMachine(),
 	}
 }
 
-func (s *Sender) Send(conn io.Writer, fileMetadata map[string]*FileMetadata, req *Request) error {
+// Send writes the files of an accepted request. Once ctx is done it stops and
+// tells the receiver why, it also stops if the receiver cancels.
+func (s *Sender) Send(ctx context.Context, conn io.ReadWriter, fileMetadata map[string]*FileMetadata, req *Request) error {
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	go s.watch(ctx, conn, cancel)
+
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
+	err := s.send(ctx, conn, fileMetadata, req)
+	if ctx.Err() == nil {
+		return err
+	}
+
+	// The receiver ended it, there's no one left to tell
+	if parent.Err() == nil {
+		return context.Cause(ctx)
+	}
+
+	resume(conn)
+	return s.Cancel(parent, conn)
+}
+
+func (s *Sender) send(ctx context.Context, conn io.Writer, fileMetadata map[string]*FileMetadata, req *Request) error {
 	counter := 1
 	speed := 0.0
 
 	for _, metadata := range fileMetadata {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		err := s.WriteHeader(conn, metadata)
+		if errors.Is(err, ErrProtocolViolation) {
+			return err
+		}
 		if err != nil {
 			fmt.Printf("[err]: %v\n", err)
 			continue
 		}
 
-		written, bs, err := s.WriteFile(conn, metadata, req, counter)
+		written, bs, err := s.WriteFile(ctx, conn, metadata, req, counter)
 		if err != nil {
 			return err
 		}
@@ -47,18 +86,78 @@ func (s *Sender) Send(conn io.Writer, fileMetadata map[string]*FileMetadata, req
 	return nil
 }
 
+// watch reads what the receiver sends during the transfer, it only speaks up
+// to cancel it
+func (s *Sender) watch(ctx context.Context, r io.Reader, cancel context.CancelCauseFunc) {
+	for {
+		idle(r)
+
+		buf := make([]byte, HeaderSize)
+		n, err := io.ReadFull(r, buf)
+		if ctx.Err() != nil {
+			return
+		}
+		// A transfer may take longer than IdleTimeout without a word
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		// Hanging up fails the writes soon enough
+		if err != nil {
+			return
+		}
+
+		hd, err := s.proto.DeserializeHeader(buf)
+		if err != nil {
+			cancel(err)
+			return
+		}
+
+		switch hd.Type {
+		case TypePing:
+		case TypeCancel:
+			cancel(readCancel(r, hd))
+			return
+		case TypeError:
+			cancel(ErrRemoteError)
+			return
+		default:
+			cancel(&ProtocolError{State: StateTransferring, Type: hd.Type})
+			return
+		}
+	}
+}
+
+// Cancel tells the receiver we give up because ctx is done, and returns the
+// *CancelError it was told.
+func (s *Sender) Cancel(ctx context.Context, w io.Writer) error {
+	if err := s.state.Next(TypeCancel); err != nil {
+		return err
+	}
+
+	reason := cancelReason(ctx)
+	if err := writeCancel(s.proto, w, reason); err != nil {
+		return err
+	}
+
+	return &CancelError{Reason: reason}
+}
+
 func (s *Sender) WriteRequest(conn net.Conn, req *Request) error {
 	serialized, err := s.proto.SerializeRequest(req)
 	if err != nil {
 		return err
 	}
 
-	hd := NewHeader(TypeRequest, uint64(RequestSize))
+	hd := NewHeader(TypeRequest, uint64(len(serialized)))
 	serializedHeader, err := s.proto.SerializeHeader(hd)
 	if err != nil {
 		return err
 	}
 
+	if err := s.state.Next(TypeRequest); err != nil {
+		return err
+	}
+
 	_, err = conn.Write(serializedHeader)
 	if err != nil {
 		return err
@@ -72,27 +171,70 @@ func (s *Sender) WriteRequest(conn net.Conn, req *Request) error {
 	return nil
 }
 
-func (s *Sender) ReadResponse(conn net.Conn) error {
-	buf := make([]byte, HeaderSize)
-	_, err := io.ReadFull(conn, buf)
+// WriteHello proves group membership to the receiver, see Group.Proof.
+func (s *Sender) WriteHello(w io.Writer, proof []byte) error {
+	header := NewHeader(TypeHello, uint64(len(proof)))
+	serializedHeader, err := s.proto.SerializeHeader(header)
 	if err != nil {
 		return err
 	}
 
-	dh, err := s.proto.DeserializeHeader(buf)
-	if err != nil {
+	if err := s.state.Next(TypeHello); err != nil {
 		return err
 	}
 
-	if dh.Type != TypeAck && dh.Type != TypeDenied {
-		return ErrInvalidResponse
+	_, err = w.Write(serializedHeader)
+	if err != nil {
+		return err
 	}
 
-	if dh.Type != TypeAck {
-		return ErrRequestDenied
-	}
+	_, err = w.Write(proof)
+	return err
+}
 
-	return nil
+// ReadResponse reads the receiver's answer to a hello or a request, skipping
+// its pings. Anything but an empty ack, denial, cancel or error is a
+// *ProtocolError.
+func (s *Sender) ReadResponse(conn net.Conn) error {
+	for {
+		idle(conn)
+
+		buf := make([]byte, HeaderSize)
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		dh, err := s.proto.DeserializeHeader(buf)
+		if err != nil {
+			return err
+		}
+
+		if err := s.state.Next(dh.Type); err != nil {
+			return err
+		}
+
+		// Responses never carry a payload, but a cancel has its reason
+		if dh.Length != 0 && dh.Type != TypeCancel {
+			return ErrInvalidResponse
+		}
+
+		switch dh.Type {
+		case TypePing:
+			// The receiver's user is still deciding
+			continue
+		case TypeAck:
+			return nil
+		case TypeDenied:
+			return ErrRequestDenied
+		case TypeCancel:
+			return readCancel(conn, dh)
+		case TypeError:
+			return ErrRemoteError
+		default:
+			return &ProtocolError{State: s.state.State(), Type: dh.Type}
+		}
+	}
 }
 
 func (s *Sender) WriteEnd(w io.Writer) error {
@@ -102,6 +244,10 @@ func (s *Sender) WriteEnd(w io.Writer) error {
 		return err
 	}
 
+	if err := s.state.Next(TypeEnd); err != nil {
+		return err
+	}
+
 	_, err = w.Write(serializedHeader)
 
 	return err
@@ -114,12 +260,16 @@ func (s *Sender) WriteHeader(w io.Writer, metadata *FileMetadata) error {
 		return err
 	}
 
-	_, err = w.Write(serializedHeader)
+	serializedMetadata, err := s.proto.SerializeFileMetadata(metadata)
 	if err != nil {
 		return err
 	}
 
-	serializedMetadata, err := s.proto.SerializeFileMetadata(metadata)
+	if err := s.state.Next(TypeFileMetadata); err != nil {
+		return err
+	}
+
+	_, err = w.Write(serializedHeader)
 	if err != nil {
 		return err
 	}
@@ -132,19 +282,61 @@ func (s *Sender) WriteHeader(w io.Writer, metadata *FileMetadata) error {
 	return nil
 }
 
-func (s *Sender) WriteFile(conn io.Writer, metadata *FileMetadata, req *Request, count int) (int64, float64, error) {
+// WriteFile writes a file's content in chunks of up to ChunkSize, checking
+// ctx between them.
+func (s *Sender) WriteFile(ctx context.Context, conn io.Writer, metadata *FileMetadata, req *Request, count int) (int64, float64, error) {
 	file, err := os.Open(metadata.AbsPath)
 	if err != nil {
 		return 0, 0, err
 	}
+	defer file.Close()
 
 	text := fmt.Sprintf("[%d/%d] Sending %s", count, req.Length, metadata.Name)
 	bar := DefaultBar(int64(metadata.Size), text)
 
-	n, err := io.CopyN(io.MultiWriter(conn, bar), file, int64(metadata.Size))
-	if err != nil {
-		return 0, 0, err
+	buf := make([]byte, ChunkSize)
+	var n int64
+	for left := metadata.Size; left > 0; {
+		if err := ctx.Err(); err != nil {
+			return 0, 0, err
+		}
+
+		chunk := buf[:min(left, uint64(ChunkSize))]
+		_, err := io.ReadFull(file, chunk)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		err = s.WriteChunk(conn, chunk)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		bar.Add(len(chunk))
+		n += int64(len(chunk))
+		left -= uint64(len(chunk))
 	}
 
 	return n, bar.State().KBsPerSecond, nil
 }
+
+// WriteChunk writes part of the current file's content.
+func (s *Sender) WriteChunk(w io.Writer, chunk []byte) error {
+	header := NewHeader(TypeChunk, uint64(len(chunk)))
+	serializedHeader, err := s.proto.SerializeHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if err := s.state.Next(TypeChunk); err != nil {
+		return err
+	}
+
+	_, err = w.Write(serializedHeader)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(chunk)
+	return err
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrProtocolViolation = errors.New("protocol violation")
+	ErrRemoteError       = errors.New("peer reported an error")
+)
+
+// State is where a connection is in the protocol. It starts in
+// StateHandshake where a group hello may be answered, a request moves it to
+// StateRequested, an ack to StateAccepted and each file's metadata to
+// StateTransferring, where the file's content follows in chunks. The end, a
+// denial, or an error or cancel from either side move it to StateEnded,
+// after which nothing may be sent. A TypePing is allowed in any state but the
+// last and changes nothing.
+type State uint8
+
+const (
+	StateHandshake State = iota
+	StateRequested
+	StateAccepted
+	StateTransferring
+	StateEnded
+)
+
+func (s State) String() string {
+	switch s {
+	case StateHandshake:
+		return "handshake"
+	case StateRequested:
+		return "requested"
+	case StateAccepted:
+		return "accepted"
+	case StateTransferring:
+		return "transferring"
+	case StateEnded:
+		return "ended"
+	default:
+		return fmt.Sprintf("state(%d)", s)
+	}
+}
+
+// ProtocolError is a message the connection's state doesn't allow, the
+// connection must be closed. It matches ErrProtocolViolation.
+type ProtocolError struct {
+	State State
+	Type  uint8
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%v: %s while %s", ErrProtocolViolation, typeName(e.Type), e.State)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return ErrProtocolViolation
+}
+
+func typeName(msgType uint8) string {
+	switch msgType {
+	case TypeRequest:
+		return "request"
+	case TypeFileMetadata:
+		return "file metadata"
+	case TypeAck:
+		return "ack"
+	case TypeEnd:
+		return "end"
+	case TypeHello:
+		return "hello"
+	case TypeDenied:
+		return "denied"
+	case TypePing:
+		return "ping"
+	case TypeChunk:
+		return "chunk"
+	case TypeCancel:
+		return "cancel"
+	case TypeError:
+		return "error"
+	default:
+		return fmt.Sprintf("type 0x%02x", msgType)
+	}
+}
+
+// StateMachine follows one connection, both ends keep one and pass every
+// message they send or receive through Next.
+type StateMachine struct {
+	state State
+	// a hello is waiting for its answer, only one is allowed
+	hello     bool
+	helloDone bool
+	file      uint32
+}
+
+func NewStateMachine() *StateMachine {
+	return &StateMachine{state: StateHandshake}
+}
+
+func (m *StateMachine) State() State {
+	return m.state
+}
+
+// File is the number of the file being transferred, starting at 1.
+func (m *StateMachine) File() uint32 {
+	return m.file
+}
+
+// InTransfer reports whether the sender may not hang up now, between the
+// ack and the end.
+func (m *StateMachine) InTransfer() bool {
+	return m.state == StateAccepted || m.state == StateTransferring
+}
+
+// Next moves past a message of msgType, or ends the connection with a
+// *ProtocolError if the current state doesn't allow it.
+func (m *StateMachine) Next(msgType uint8) error {
+	if m.state != StateEnded {
+		switch msgType {
+		case TypeError, TypeCancel:
+			m.state = StateEnded
+			return nil
+		case TypePing:
+			return nil
+		}
+	}
+
+	next, ok := m.next(msgType)
+	if !ok {
+		err := &ProtocolError{State: m.state, Type: msgType}
+		m.state = StateEnded
+		return err
+	}
+
+	m.state = next
+	return nil
+}
+
+func (m *StateMachine) next(msgType uint8) (State, bool) {
+	switch m.state {
+	case StateHandshake:
+		switch {
+		case msgType == TypeHello && !m.hello && !m.helloDone:
+			m.hello = true
+			return StateHandshake, true
+		case msgType == TypeAck && m.hello:
+			m.hello, m.helloDone = false, true
+			return StateHandshake, true
+		case msgType == TypeDenied && m.hello:
+			return StateEnded, true
+		case msgType == TypeRequest && !m.hello:
+			return StateRequested, true
+		}
+
+	case StateRequested:
+		switch msgType {
+		case TypeAck:
+			return StateAccepted, true
+		case TypeDenied:
+			return StateEnded, true
+		}
+
+	case StateAccepted, StateTransferring:
+		switch msgType {
+		case TypeChunk:
+			if m.state == StateTransferring {
+				return StateTransferring, true
+			}
+		case TypeFileMetadata:
+			m.file++
+			return StateTransferring, true
+		case TypeEnd:
+			return StateEnded, true
+		}
+	}
+
+	return m.state, false
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Dyastin-0/gobyte/tofu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateMachine(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs []uint8
+		// index of the message that is a violation, -1 for none
+		bad  int
+		want State
+	}{
+		{
+			name: "transfer",
+			msgs: []uint8{TypeRequest, TypeAck, TypeFileMetadata, TypeFileMetadata, TypeEnd},
+			bad:  -1,
+			want: StateEnded,
+		},
+		{
+			name: "group transfer",
+			msgs: []uint8{TypeHello, TypeAck, TypeRequest, TypeAck, TypeEnd},
+			bad:  -1,
+			want: StateEnded,
+		},
+		{
+			name: "denied",
+			msgs: []uint8{TypeRequest, TypeDenied},
+			bad:  -1,
+			want: StateEnded,
+		},
+		{
+			name: "error mid transfer",
+			msgs: []uint8{TypeRequest, TypeAck, TypeFileMetadata, TypeError},
+			bad:  -1,
+			want: StateEnded,
+		},
+		{
+			name: "cancel mid file",
+			msgs: []uint8{TypeRequest, TypeAck, TypeFileMetadata, TypeChunk, TypeCancel},
+			bad:  -1,
+			want: StateEnded,
+		},
+		{
+			name: "cancel while prompting",
+			msgs: []uint8{TypeRequest, TypePing, TypeCancel},
+			bad:  -1,
+			want: StateEnded,
+		},
+		{
+			name: "second request",
+			msgs: []uint8{TypeRequest, TypeAck, TypeRequest},
+			bad:  2,
+		},
+		{
+			name: "request before its answer",
+			msgs: []uint8{TypeRequest, TypeRequest},
+			bad:  1,
+		},
+		{
+			name: "file before ack",
+			msgs: []uint8{TypeRequest, TypeFileMetadata},
+			bad:  1,
+		},
+		{
+			name: "chunk before file",
+			msgs: []uint8{TypeRequest, TypeAck, TypeChunk},
+			bad:  2,
+		},
+		{
+			name: "cancel after end",
+			msgs: []uint8{TypeRequest, TypeAck, TypeEnd, TypeCancel},
+			bad:  3,
+		},
+		{
+			name: "file before request",
+			msgs: []uint8{TypeFileMetadata},
+			bad:  0,
+		},
+		{
+			name: "end before request",
+			msgs: []uint8{TypeEnd},
+			bad:  0,
+		},
+		{
+			name: "ack without request",
+			msgs: []uint8{TypeAck},
+			bad:  0,
+		},
+		{
+			name: "second hello",
+			msgs: []uint8{TypeHello, TypeAck, TypeHello},
+			bad:  2,
+		},
+		{
+			name: "request before hello answer",
+			msgs: []uint8{TypeHello, TypeRequest},
+			bad:  1,
+		},
+		{
+			name: "hello after request",
+			msgs: []uint8{TypeRequest, TypeAck, TypeHello},
+			bad:  2,
+		},
+		{
+			name: "ack mid transfer",
+			msgs: []uint8{TypeRequest, TypeAck, TypeFileMetadata, TypeAck},
+			bad:  3,
+		},
+		{
+			name: "file after end",
+			msgs: []uint8{TypeRequest, TypeAck, TypeEnd, TypeFileMetadata},
+			bad:  3,
+		},
+		{
+			name: "error after end",
+			msgs: []uint8{TypeRequest, TypeDenied, TypeError},
+			bad:  2,
+		},
+		{
+			name: "unknown type",
+			msgs: []uint8{0x7f},
+			bad:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewStateMachine()
+
+			for i, msgType := range tt.msgs {
+				before := m.State()
+				err := m.Next(msgType)
+				if i != tt.bad {
+					require.NoError(t, err, "message %d", i)
+					continue
+				}
+
+				var perr *ProtocolError
+				require.ErrorAs(t, err, &perr, "message %d", i)
+				assert.ErrorIs(t, err, ErrProtocolViolation)
+				assert.Equal(t, before, perr.State)
+				assert.Equal(t, msgType, perr.Type)
+				assert.Equal(t, StateEnded, m.State(), "a violation ends the connection")
+				return
+			}
+
+			assert.Equal(t, tt.want, m.State())
+		})
+	}
+}
+
+// frame is a message as a sender would write it
+func frame(t *testing.T, msgType uint8, payload []byte) []byte {
+	t.Helper()
+
+	hd, err := NewProto().SerializeHeader(NewHeader(msgType, uint64(len(payload))))
+	require.NoError(t, err)
+
+	return append(hd, payload...)
+}
+
+func TestReceiverProtocolViolation(t *testing.T) {
+	p := NewProto()
+	req, err := p.SerializeRequest(NewRequest(5, 1))
+	require.NoError(t, err)
+
+	request := frame(t, TypeRequest, req)
+	hello := frame(t, TypeHello, []byte("proof"))
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		// what the receiver answers, the last one ends the connection
+		want []uint8
+		// the sender hangs up once it has the answers
+		hangUp  bool
+		wantErr error
+	}{
+		{
+			name:    "second request",
+			frames:  [][]byte{request, request},
+			want:    []uint8{TypeAck, TypeError},
+			wantErr: ErrProtocolViolation,
+		},
+		{
+			name:    "file before request",
+			frames:  [][]byte{frame(t, TypeFileMetadata, nil)},
+			want:    []uint8{TypeError},
+			wantErr: ErrProtocolViolation,
+		},
+		{
+			name:    "end before request",
+			frames:  [][]byte{frame(t, TypeEnd, nil)},
+			want:    []uint8{TypeError},
+			wantErr: ErrProtocolViolation,
+		},
+		{
+			name:    "ack from the sender",
+			frames:  [][]byte{request, frame(t, TypeAck, nil)},
+			want:    []uint8{TypeAck, TypeError},
+			wantErr: ErrProtocolViolation,
+		},
+		{
+			name:    "request after end",
+			frames:  [][]byte{request, frame(t, TypeEnd, nil), request},
+			want:    []uint8{TypeAck, TypeError},
+			wantErr: ErrProtocolViolation,
+		},
+		{
+			name:    "second hello",
+			frames:  [][]byte{hello, hello},
+			want:    []uint8{TypeAck, TypeError},
+			wantErr: ErrProtocolViolation,
+		},
+		{
+			name:    "hang up mid transfer",
+			frames:  [][]byte{request},
+			want:    []uint8{TypeAck},
+			hangUp:  true,
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "sender error",
+			frames:  [][]byte{request, frame(t, TypeError, nil)},
+			want:    []uint8{TypeAck},
+			wantErr: ErrRemoteError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReceiver(t.TempDir())
+			from := &Identity{ID: "friend", Permissions: tofu.Permissions{AutoAccept: true}}
+
+			sender, receiver := net.Pipe()
+			defer receiver.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				defer sender.Close()
+				done <- r.receive(context.Background(), sender, from)
+			}()
+
+			go func() {
+				for _, f := range tt.frames {
+					if _, err := receiver.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+
+			var got []uint8
+			for {
+				if tt.hangUp && len(got) == len(tt.want) {
+					receiver.Close()
+					break
+				}
+
+				buf := make([]byte, HeaderSize)
+				if _, err := io.ReadFull(receiver, buf); err != nil {
+					break
+				}
+
+				hd, err := p.DeserializeHeader(buf)
+				require.NoError(t, err)
+				got = append(got, hd.Type)
+			}
+
+			assert.Equal(t, tt.want, got)
+			assert.ErrorIs(t, <-done, tt.wantErr)
+		})
+	}
+}
+
+func TestSenderProtocolViolation(t *testing.T) {
+	t.Run("response with a payload", func(t *testing.T) {
+		sender, receiver := net.Pipe()
+		defer receiver.Close()
+		defer sender.Close()
+
+		go sender.Write(frame(t, TypeAck, []byte("extra")))
+
+		s := NewSender()
+		require.NoError(t, s.state.Next(TypeRequest))
+		assert.ErrorIs(t, s.ReadResponse(receiver), ErrInvalidResponse)
+	})
+
+	t.Run("file metadata as a response", func(t *testing.T) {
+		sender, receiver := net.Pipe()
+		defer receiver.Close()
+		defer sender.Close()
+
+		go sender.Write(frame(t, TypeFileMetadata, nil))
+
+		s := NewSender()
+		require.NoError(t, s.state.Next(TypeRequest))
+		assert.ErrorIs(t, s.ReadResponse(receiver), ErrProtocolViolation)
+	})
+
+	t.Run("receiver error", func(t *testing.T) {
+		sender, receiver := net.Pipe()
+		defer receiver.Close()
+		defer sender.Close()
+
+		go sender.Write(frame(t, TypeError, nil))
+
+		s := NewSender()
+		require.NoError(t, s.state.Next(TypeRequest))
+		assert.ErrorIs(t, s.ReadResponse(receiver), ErrRemoteError)
+	})
+
+	t.Run("writes out of order", func(t *testing.T) {
+		s := NewSender()
+		assert.ErrorIs(t, s.WriteEnd(io.Discard), ErrProtocolViolation)
+
+		s = NewSender()
+		require.NoError(t, s.WriteRequest(nopConn{}, NewRequest(5, 1)))
+		assert.ErrorIs(t, s.WriteRequest(nopConn{}, NewRequest(5, 1)), ErrProtocolViolation)
+	})
+}
+
+// nopConn discards everything written to it
+type nopConn struct {
+	net.Conn
+}
+
+func (nopConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -15,7 +16,7 @@ func TestSendMany(t *testing.T) {
 	dir1 := t.TempDir()
 	s := NewSender()
 	r := NewReceiver(dir1)
-	r.OnRequest = func(req *Request) bool { return true }
+	r.OnRequest = func(ctx context.Context, req *Request, from *Identity) bool { return true }
 	size, metadata, err := createNFiles(1000, dir)
 	require.NoError(t, err)
 
@@ -23,7 +24,7 @@ func TestSendMany(t *testing.T) {
 	defer sender.Close()
 	defer receiver.Close()
 
-	go r.receive(sender)
+	go r.receive(context.Background(), sender, nil)
 
 	req := NewRequest(size, uint32(len(metadata)))
 	s.WriteRequest(receiver, req)
@@ -31,7 +32,7 @@ func TestSendMany(t *testing.T) {
 	err = s.ReadResponse(receiver)
 	require.NoError(t, err)
 
-	err = s.Send(receiver, metadata, req)
+	err = s.Send(context.Background(), receiver, metadata, req)
 	require.NoError(t, err)
 
 	err = s.WriteEnd(receiver)
@@ -0,0 +1,147 @@
+package tofu
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestPeerWith(t *testing.T, id, algorithm string) *Tofu {
+	t.Helper()
+
+	tofu := &Tofu{
+		ID:        id,
+		CertPath:  t.TempDir(),
+		TrustPath: filepath.Join(t.TempDir(), "trust.json"),
+		OnNewPeer: UnsafeNewPeerHandler,
+		Algorithm: algorithm,
+	}
+
+	cert, err := tofu.newSelfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tofu.Certificate = cert
+
+	return tofu
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	peers := map[string]*Tofu{}
+	for _, algorithm := range []string{AlgorithmECDSAP256, AlgorithmEd25519, AlgorithmRSA3072} {
+		peer := newTestPeerWith(t, algorithm, algorithm)
+		peers[algorithm] = peer
+
+		leaf, err := peer.Leaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := KeyAlgorithm(leaf); got != algorithm {
+			t.Errorf("expected a %s key, got %s", algorithm, got)
+		}
+		if fp := Fingerprint(leaf); !strings.HasPrefix(fp, algorithm+":sha256:") || validFingerprint(fp) != nil {
+			t.Errorf("expected a valid fingerprint prefixed with %s, got %s", algorithm, fp)
+		}
+	}
+
+	if _, err := generateKey("dsa-1024"); !errors.Is(err, ErrorUnsupportedAlgorithm) {
+		t.Errorf("expected ErrorUnsupportedAlgorithm, got: %v", err)
+	}
+
+	// Different key types pair with each other
+	server, client := peers[AlgorithmEd25519], peers[AlgorithmRSA3072]
+	res := connect(t, server, client)
+	if res.serverErr != nil || res.clientErr != nil {
+		t.Fatalf("expected ed25519 and rsa peers to pair, got %v, %v", res.serverErr, res.clientErr)
+	}
+
+	entry, err := client.Entry(server.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Algorithm != AlgorithmEd25519 || entry.Fingerprint != Fingerprint(server.Certificate.Leaf) {
+		t.Errorf("unexpected entry for the ed25519 peer: %+v", entry)
+	}
+
+	// And trust each other from then on
+	res = connect(t, server, client)
+	if res.serverErr != nil || res.clientErr != nil {
+		t.Fatalf("expected paired peers to connect, got %v, %v", res.serverErr, res.clientErr)
+	}
+}
+
+func TestRotateToAnotherAlgorithm(t *testing.T) {
+	peer := newTestPeer(t, "peer")
+	original := peer.Certificate.Leaf
+
+	verifier := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	if err := verifier.Add("peer", Fingerprint(original)); err != nil {
+		t.Fatal(err)
+	}
+
+	// ecdsa signs for ed25519, which signs for rsa
+	for _, algorithm := range []string{AlgorithmEd25519, AlgorithmRSA3072} {
+		peer.Algorithm = algorithm
+		if _, err := peer.Rotate(); err != nil {
+			t.Fatalf("failed to rotate to %s: %v", algorithm, err)
+		}
+	}
+
+	leaf, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeyAlgorithm(leaf) != AlgorithmRSA3072 {
+		t.Fatalf("expected an rsa key, got %s", KeyAlgorithm(leaf))
+	}
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	if err := verifier.verify(state, ""); err != nil {
+		t.Fatalf("expected rotations across key types to be followed, got: %v", err)
+	}
+}
+
+func TestUnprefixedPin(t *testing.T) {
+	peer := newTestPeer(t, "peer")
+	leaf := peer.Certificate.Leaf
+
+	// Pins written before fingerprints named the algorithm
+	verifier := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	if err := verifier.Add("peer", digest(Fingerprint(leaf))); err != nil {
+		t.Fatal(err)
+	}
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	if err := verifier.verify(state, ""); err != nil {
+		t.Fatalf("expected an unprefixed pin to match, got: %v", err)
+	}
+
+	entry, err := verifier.Entry("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Fingerprint != Fingerprint(leaf) || !entry.HasFlag(FlagVerified) {
+		t.Errorf("expected the pin to gain the prefix and stay verified: %+v", entry)
+	}
+}
+
+func TestValidFingerprint(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+
+	for fp, valid := range map[string]bool{
+		"sha256:" + hex:             true,
+		"ed25519:sha256:" + hex:     true,
+		"rsa-3072:sha256:" + hex:    true,
+		"md5:" + hex:                false,
+		"ed25519:sha256:" + hex[2:]: false,
+		"Bad Alg:sha256:" + hex:     false,
+		":sha256:" + hex:            false,
+	} {
+		if err := validFingerprint(fp); (err == nil) != valid {
+			t.Errorf("validFingerprint(%q) = %v, expected valid %v", fp, err, valid)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package tofu
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Block refuses a peer by its ID, its fingerprint or both, before any
+// prompt and whatever its certificate says.
+type Block struct {
+	ID          string    `json:"id,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+func (b *Block) matches(peerID, fingerprint string) bool {
+	return (b.ID != "" && b.ID == peerID) || (b.Fingerprint != "" && sameFingerprint(b.Fingerprint, fingerprint))
+}
+
+func blocked(blocks []*Block, peerID, fingerprint string) bool {
+	return slices.ContainsFunc(blocks, func(b *Block) bool {
+		return b.matches(peerID, fingerprint)
+	})
+}
+
+// Block refuses a peer from now on, target is either its ID or a fingerprint.
+// A trusted peer is no longer trusted, and blocking it by ID blocks the key it
+// was pinned to as well so it can't come back under another name.
+func (t *Tofu) Block(target, reason string) error {
+	b := &Block{Reason: reason, At: time.Now()}
+	if validFingerprint(target) == nil {
+		b.Fingerprint = target
+	} else if err := validPeerID(target); err != nil {
+		return err
+	} else {
+		b.ID = target
+	}
+
+	return t.updateStore(func(s *store) error {
+		if entry, ok := s.peers[b.ID]; ok && entry.Fingerprint != legacyFingerprint {
+			b.Fingerprint = entry.Fingerprint
+		}
+
+		// The peer is gone from the trusted ones once blocked, keep the key
+		// it was blocked with
+		for _, old := range s.blocked {
+			if b.ID != "" && b.Fingerprint == "" && old.ID == b.ID {
+				b.Fingerprint = old.Fingerprint
+			}
+		}
+
+		// Blocking again only updates the reason
+		s.blocked = slices.DeleteFunc(s.blocked, func(old *Block) bool {
+			return old.ID == b.ID && sameFingerprint(old.Fingerprint, b.Fingerprint)
+		})
+		s.blocked = append(s.blocked, b)
+
+		for id, entry := range s.peers {
+			if b.matches(id, entry.Fingerprint) {
+				delete(s.peers, id)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Unblock lifts every block on target, an ID or a fingerprint. The peer has
+// to pair again.
+func (t *Tofu) Unblock(target string) error {
+	return t.updateStore(func(s *store) error {
+		n := len(s.blocked)
+		s.blocked = slices.DeleteFunc(s.blocked, func(b *Block) bool {
+			return b.ID == target || (b.Fingerprint != "" && sameFingerprint(b.Fingerprint, target))
+		})
+
+		if len(s.blocked) == n {
+			return fmt.Errorf("%w: %s", ErrorPeerNotBlocked, target)
+		}
+		return nil
+	})
+}
+
+// Blocks lists every block, oldest first.
+func (t *Tofu) Blocks() ([]*Block, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.blocked, nil
+}
+
+// IsBlocked reports whether a peer is blocked by its ID or fingerprint,
+// either may be empty.
+func (t *Tofu) IsBlocked(peerID, fingerprint string) (bool, error) {
+	blocks, err := t.cachedBlocks()
+	if err != nil {
+		return false, err
+	}
+
+	return blocked(blocks, peerID, fingerprint), nil
+}
+
+// cachedBlocks is Blocks without reading the trust database again until it
+// changes, IsBlocked runs for every announcement we hear. Saving always
+// replaces the file, so another process blocking a peer is noticed too.
+func (t *Tofu) cachedBlocks() ([]*Block, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.TrustPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if from := t.blocksFrom; from != nil && os.SameFile(from, info) &&
+		from.ModTime().Equal(info.ModTime()) && from.Size() == info.Size() {
+		return t.blocks, nil
+	}
+
+	s, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	t.blocks, t.blocksFrom = s.blocked, info
+	return t.blocks, nil
+}
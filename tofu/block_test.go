@@ -0,0 +1,130 @@
+package tofu
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlock(t *testing.T) {
+	peer := newTestPeer(t, "nuisance")
+	leaf, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := Fingerprint(leaf)
+
+	tofu := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	if err := tofu.Add("nuisance", fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if err := tofu.Add("friend", "sha256:"+strings.Repeat("be", 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tofu.Block("nuisance", "keeps sending memes"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+
+	if _, err := tofu.Entry("nuisance"); !errors.Is(err, ErrorPeerNotTrusted) {
+		t.Error("expected a blocked peer to no longer be trusted")
+	}
+	if _, err := tofu.Entry("friend"); err != nil {
+		t.Errorf("expected other peers to stay trusted: %v", err)
+	}
+
+	// Its key stays blocked under any name
+	for _, id := range []string{"nuisance", "renamed"} {
+		if blocked, err := tofu.IsBlocked(id, fingerprint); err != nil || !blocked {
+			t.Errorf("expected %s to be blocked, got %v, %v", id, blocked, err)
+		}
+	}
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	if err := tofu.verify(state, ""); !errors.Is(err, ErrorPeerBlocked) {
+		t.Errorf("expected ErrorPeerBlocked, got: %v", err)
+	}
+	if err := tofu.Add("nuisance", fingerprint); !errors.Is(err, ErrorPeerBlocked) {
+		t.Errorf("expected blocked peers not to be added, got: %v", err)
+	}
+
+	// Blocking by fingerprint, and again, only keeps one block each
+	if err := tofu.Block("sha256:"+strings.Repeat("00", 32), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tofu.Block("nuisance", "still"); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := tofu.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[1].Reason != "still" {
+		t.Errorf("unexpected blocks: %+v", blocks)
+	}
+
+	if err := tofu.Unblock("nuisance"); err != nil {
+		t.Fatalf("failed to unblock: %v", err)
+	}
+	if err := tofu.Unblock("nuisance"); !errors.Is(err, ErrorPeerNotBlocked) {
+		t.Errorf("expected ErrorPeerNotBlocked, got: %v", err)
+	}
+
+	// Unblocked peers pair again
+	if err := tofu.verify(state, ""); err != nil {
+		t.Errorf("expected an unblocked peer to be left to pairing, got: %v", err)
+	}
+}
+
+func TestIsBlockedCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trust.json")
+	tofu := &Tofu{TrustPath: path}
+	other := &Tofu{TrustPath: path}
+
+	check := func(want bool) {
+		t.Helper()
+		blocked, err := tofu.IsBlocked("nuisance", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocked != want {
+			t.Errorf("expected blocked to be %v", want)
+		}
+	}
+
+	check(false)
+	if err := tofu.Block("nuisance", ""); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+	if err := tofu.Unblock("nuisance"); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+
+	// Blocked from another process, like the block command while we listen
+	if err := other.Block("nuisance", ""); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+
+	// Unchanged as far as stat can tell, the cached blocklist is used
+	// without reading the file
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := []byte(strings.Repeat("x", int(info.Size())))
+	if err := os.WriteFile(path, garbage, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+}
@@ -0,0 +1,205 @@
+package tofu
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// Policy decides which peers are trusted.
+type Policy string
+
+const (
+	// PolicyTOFU pins every peer on first use, the default
+	PolicyTOFU Policy = "tofu"
+	// PolicyCA only accepts peers with a certificate signed by one of CAs
+	PolicyCA Policy = "ca"
+	// PolicyCAOrTOFU accepts peers signed by one of CAs without prompting and
+	// pins the others on first use
+	PolicyCAOrTOFU Policy = "ca-or-tofu"
+)
+
+// ParsePolicy returns the policy named s, "" is PolicyTOFU.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return PolicyTOFU, nil
+	case PolicyTOFU, PolicyCA, PolicyCAOrTOFU:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrorInvalidPolicy, s)
+	}
+}
+
+// LoadCAs reads a PEM bundle of CA certificates.
+func LoadCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: %s", ErrorNoCAs, path)
+	}
+
+	return pool, nil
+}
+
+func (t *Tofu) usesCA() bool {
+	return t.Policy == PolicyCA || t.Policy == PolicyCAOrTOFU
+}
+
+// verifyCA checks the peer's certificate chains to one of CAs, the CA vouches
+// for the ID in it
+func (t *Tofu) verifyCA(cs tls.ConnectionState) error {
+	if t.CAs == nil {
+		return ErrorNoCAs
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         t.CAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorNotSignedByCA, err)
+	}
+
+	for _, chain := range chains {
+		if err := t.checkRevoked(chain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadCRL reads a certificate revocation list, PEM or DER, its signature is
+// checked against the issuing CA when it is used.
+func LoadCRL(path string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	return x509.ParseRevocationList(data)
+}
+
+// checkRevoked refuses a chain if a CRL signed by the issuer of any of its
+// certificates lists it
+func (t *Tofu) checkRevoked(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+
+		for _, crl := range t.CRLs {
+			if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+
+			for _, revoked := range crl.RevokedCertificateEntries {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("%w: %s, serial %s", ErrorCertRevoked, cert.Subject.CommonName, cert.SerialNumber)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// caSigned reports whether the peer is trusted through CAs alone
+func (t *Tofu) caSigned(cs tls.ConnectionState) bool {
+	return t.usesCA() && len(cs.PeerCertificates) > 0 && t.verifyCA(cs) == nil
+}
+
+// CSR returns a PEM certificate signing request for our key, for the CA to
+// sign and ImportCert to install.
+func (t *Tofu) CSR() ([]byte, error) {
+	key, ok := t.Certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrorUnsupportedKey
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: t.ID,
+		},
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// ImportCert replaces our certificate with one issued for our key, followed
+// by any intermediates the CA returned.
+func (t *Tofu) ImportCert(data []byte) error {
+	var chain [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return ErrorNoCertificateFound
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+
+	ours, err := t.Leaf()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, ours.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("%w: it is for another key", ErrorCertMismatch)
+	}
+	if leaf.Subject.CommonName != t.ID {
+		return fmt.Errorf("%w: it is for %q", ErrorCertMismatch, leaf.Subject.CommonName)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	certFile, _ := t.certFiles()
+	if err := WriteFileAtomic(certFile, certPEM, 0600); err != nil {
+		return err
+	}
+
+	t.Certificate = &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  t.Certificate.PrivateKey,
+		Leaf:        leaf,
+	}
+
+	return nil
+}
+
+// selfSigned is false for certificates issued by a CA, we can't renew those
+func selfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject)
+}
@@ -0,0 +1,301 @@
+package tofu
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// enroll signs peer's CSR and imports the certificate
+func (ca *testCA) enroll(t *testing.T, peer *Tofu) {
+	t.Helper()
+
+	csrPEM, err := peer.CSR()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(csrPEM)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.ImportCert(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		t.Fatalf("failed to import certificate: %v", err)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for in, want := range map[string]Policy{"": PolicyTOFU, "ca": PolicyCA, "ca-or-tofu": PolicyCAOrTOFU} {
+		if got, err := ParsePolicy(in); err != nil || got != want {
+			t.Errorf("ParsePolicy(%q) = %q, %v, expected %q", in, got, err, want)
+		}
+	}
+
+	if _, err := ParsePolicy("anything"); !errors.Is(err, ErrorInvalidPolicy) {
+		t.Errorf("expected ErrorInvalidPolicy, got: %v", err)
+	}
+}
+
+func TestImportCert(t *testing.T) {
+	ca := newTestCA(t)
+	peer := newTestPeer(t, "peer")
+	before := Fingerprint(peer.Certificate.Leaf)
+
+	ca.enroll(t, peer)
+
+	leaf, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selfSigned(leaf) || Fingerprint(leaf) != before {
+		t.Error("expected a CA issued certificate for the same key")
+	}
+
+	// Loading it back keeps it, even when it is about to expire
+	defer func(d time.Duration) { RenewBefore = d }(RenewBefore)
+	RenewBefore = 2 * time.Hour
+
+	cert, err := peer.cert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selfSigned(cert.Leaf) {
+		t.Error("expected the CA issued certificate not to be renewed")
+	}
+
+	// A certificate for someone else's key is refused
+	other := newTestPeer(t, "peer")
+	certFile, _ := other.certFiles()
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.ImportCert(data); !errors.Is(err, ErrorCertMismatch) {
+		t.Errorf("expected ErrorCertMismatch, got: %v", err)
+	}
+}
+
+func TestCAPolicy(t *testing.T) {
+	ca := newTestCA(t)
+
+	prompted := func(t *testing.T, peer *Tofu) *bool {
+		asked := false
+		peer.OnNewPeer = func(id, fingerprint, code string) bool {
+			asked = true
+			return true
+		}
+		return &asked
+	}
+
+	t.Run("enrolled peers skip pairing", func(t *testing.T) {
+		server := newTestPeer(t, "server")
+		client := newTestPeer(t, "client")
+		ca.enroll(t, server)
+		ca.enroll(t, client)
+
+		for _, peer := range []*Tofu{server, client} {
+			peer.Policy = PolicyCA
+			peer.CAs = ca.pool
+		}
+		serverAsked := prompted(t, server)
+		clientAsked := prompted(t, client)
+
+		res := connect(t, server, client)
+		if res.serverErr != nil || res.clientErr != nil {
+			t.Fatalf("expected enrolled peers to connect, got %v, %v", res.serverErr, res.clientErr)
+		}
+		if *serverAsked || *clientAsked {
+			t.Error("expected no prompts for enrolled peers")
+		}
+	})
+
+	t.Run("ca mode refuses others", func(t *testing.T) {
+		server := newTestPeer(t, "server")
+		client := newTestPeer(t, "client")
+		ca.enroll(t, client)
+
+		client.Policy = PolicyCA
+		client.CAs = ca.pool
+
+		res := connect(t, server, client)
+		if !errors.Is(res.clientErr, ErrorNotSignedByCA) {
+			t.Errorf("expected ErrorNotSignedByCA, got: %v", res.clientErr)
+		}
+	})
+
+	t.Run("ca-or-tofu falls back to pairing", func(t *testing.T) {
+		server := newTestPeer(t, "server")
+		client := newTestPeer(t, "client")
+		ca.enroll(t, server)
+
+		client.Policy = PolicyCAOrTOFU
+		client.CAs = ca.pool
+		server.Policy = PolicyCAOrTOFU
+		server.CAs = ca.pool
+		serverAsked := prompted(t, server)
+		clientAsked := prompted(t, client)
+
+		res := connect(t, server, client)
+		if res.serverErr != nil || res.clientErr != nil {
+			t.Fatalf("expected pairing to succeed, got %v, %v", res.serverErr, res.clientErr)
+		}
+
+		// Only the server has to confirm the client, it isn't enrolled
+		if !*serverAsked || *clientAsked {
+			t.Errorf("expected only the server to be prompted, got server %v, client %v", *serverAsked, *clientAsked)
+		}
+		if _, err := server.Entry("client"); err != nil {
+			t.Errorf("expected the client to be pinned: %v", err)
+		}
+	})
+}
+
+func TestRevokedCert(t *testing.T) {
+	ca := newTestCA(t)
+	peer := newTestPeer(t, "peer")
+	ca.enroll(t, peer)
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: peer.Certificate.Leaf.SerialNumber, RevocationTime: time.Now()},
+		},
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := LoadCRL(path)
+	if err != nil {
+		t.Fatalf("failed to load CRL: %v", err)
+	}
+
+	verifier := newTestPeer(t, "verifier")
+	verifier.Policy = PolicyCA
+	verifier.CAs = ca.pool
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer.Certificate.Leaf}}
+	if err := verifier.verify(state, ""); err != nil {
+		t.Fatalf("expected the peer to be accepted before revocation, got: %v", err)
+	}
+
+	verifier.CRLs = []*x509.RevocationList{crl}
+	if err := verifier.verify(state, ""); !errors.Is(err, ErrorCertRevoked) {
+		t.Errorf("expected ErrorCertRevoked, got: %v", err)
+	}
+
+	// A list someone else signed doesn't revoke anything
+	other := newTestCA(t)
+	der, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: peer.Certificate.Leaf.SerialNumber, RevocationTime: time.Now()},
+		},
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, other.cert, other.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier.CRLs = []*x509.RevocationList{forged}
+	if err := verifier.verify(state, ""); err != nil {
+		t.Errorf("expected a CRL from another CA to be ignored, got: %v", err)
+	}
+}
+
+func TestLoadCAs(t *testing.T) {
+	ca := newTestCA(t)
+	path := filepath.Join(t.TempDir(), "ca.pem")
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCAs(path); err != nil {
+		t.Errorf("failed to load CAs: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("nothing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCAs(path); !errors.Is(err, ErrorNoCAs) {
+		t.Errorf("expected ErrorNoCAs, got: %v", err)
+	}
+}
@@ -1,30 +1,133 @@
 package tofu
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
 	"time"
 )
 
-// returns a new self signed certificate if nothing is found at path
+// Key algorithms we can create identities with, named like KeyAlgorithm does
+const (
+	AlgorithmECDSAP256 = "ecdsa-p256"
+	AlgorithmEd25519   = "ed25519"
+	AlgorithmRSA3072   = "rsa-3072"
+)
+
+// ParseAlgorithm returns the key algorithm named s, "" is AlgorithmECDSAP256.
+func ParseAlgorithm(s string) (string, error) {
+	switch s {
+	case "":
+		return AlgorithmECDSAP256, nil
+	case AlgorithmECDSAP256, AlgorithmEd25519, AlgorithmRSA3072:
+		return s, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrorUnsupportedAlgorithm, s)
+	}
+}
+
+var (
+	// CertValidity is how long issued certificates are valid for
+	CertValidity = 365 * 24 * time.Hour
+
+	// Certificates expiring within RenewBefore are re-issued on Init
+	RenewBefore = 30 * 24 * time.Hour
+)
+
+func (t *Tofu) certFiles() (string, string) {
+	return filepath.Join(t.CertPath, t.ID+".crt"), filepath.Join(t.CertPath, t.ID+".key")
+}
+
+// journalFile lists files staged by writeFiles that are being moved into place
+func (t *Tofu) journalFile() string {
+	return filepath.Join(t.CertPath, t.ID+".journal")
+}
+
+// writeFiles replaces files all at once. Each is staged next to its target,
+// then the journal commits to them and they are moved into place. A crash
+// before the journal leaves the old files, one after it is finished by the
+// next finishWrite.
+func (t *Tofu) writeFiles(files map[string][]byte) error {
+	if err := t.stageFiles(files); err != nil {
+		return err
+	}
+	return t.finishWrite()
+}
+
+func (t *Tofu) stageFiles(files map[string][]byte) error {
+	paths := make([]string, 0, len(files))
+	for path, data := range files {
+		if err := WriteFileAtomic(path+".new", data, 0600); err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+
+	journal, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(t.journalFile(), journal, 0600)
+}
+
+// finishWrite moves the files of an interrupted writeFiles into place
+func (t *Tofu) finishWrite() error {
+	journal, err := os.ReadFile(t.journalFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	if err := json.Unmarshal(journal, &paths); err != nil {
+		return fmt.Errorf("failed to read %s: %w", t.journalFile(), err)
+	}
+
+	for _, path := range paths {
+		// Already moved before the crash
+		if err := os.Rename(path+".new", path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Remove(t.journalFile())
+}
+
+// returns a new self signed certificate if nothing is found at path, and
+// renews the one found if it is about to expire, unless a CA issued it
 func (t *Tofu) cert() (*tls.Certificate, error) {
-	certFile := filepath.Join(t.CertPath, t.ID+".crt")
-	keyFile := filepath.Join(t.CertPath, t.ID+".key")
+	if err := t.finishWrite(); err != nil {
+		return nil, err
+	}
+
+	certFile, keyFile := t.certFiles()
 
 	if _, err := os.Stat(certFile); err == nil {
 		if _, err := os.Stat(keyFile); err == nil {
-			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			cert, err := t.loadKeyPair(certFile, keyFile)
 			if err != nil {
 				return nil, err
 			}
+
+			if time.Until(cert.Leaf.NotAfter) < RenewBefore && selfSigned(cert.Leaf) {
+				return t.renew(&cert)
+			}
+
 			return &cert, nil
 		}
 	}
@@ -32,8 +135,46 @@ func (t *Tofu) cert() (*tls.Certificate, error) {
 	return t.newSelfSignedCert()
 }
 
-func (t *Tofu) newSelfSignedCert() (*tls.Certificate, error) {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// renew re-issues cert with the same key, so peers that pinned its
+// fingerprint keep trusting us
+func (t *Tofu) renew(cert *tls.Certificate) (*tls.Certificate, error) {
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrorUnsupportedKey
+	}
+
+	// Keep presenting our rotations, peers may not have seen them yet
+	rotations, err := t.rotations()
+	if err != nil {
+		return nil, err
+	}
+
+	certDER, err := t.issue(key, rotations)
+	if err != nil {
+		return nil, err
+	}
+
+	certFile, _ := t.certFiles()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	if err := WriteFileAtomic(certFile, certPEM, 0600); err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// issue self signs a certificate for key, valid for CertValidity
+func (t *Tofu) issue(key crypto.Signer, rotations []*Rotation) ([]byte, error) {
+	extensions, err := rotationExtension(rotations)
 	if err != nil {
 		return nil, err
 	}
@@ -49,41 +190,62 @@ func (t *Tofu) newSelfSignedCert() (*tls.Certificate, error) {
 			CommonName: t.ID,
 		},
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		NotAfter:              time.Now().Add(CertValidity),
+		KeyUsage:              keyUsage(key),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		ExtraExtensions:       extensions,
+	}
+
+	return x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+}
+
+// generateKey creates a key for algorithm, "" is AlgorithmECDSAP256
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "", AlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case AlgorithmRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrorUnsupportedAlgorithm, algorithm)
 	}
+}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+func (t *Tofu) newSelfSignedCert() (*tls.Certificate, error) {
+	privateKey, err := generateKey(t.Algorithm)
 	if err != nil {
 		return nil, err
 	}
 
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	privDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	certDER, err := t.issue(privateKey, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
-
-	certFile := filepath.Join(t.CertPath, t.ID+".crt")
-	keyFile := filepath.Join(t.CertPath, t.ID+".key")
+	return t.writeCert(certDER, privateKey, nil)
+}
 
-	if err = os.WriteFile(certFile, certPEM, 0600); err != nil {
-		return nil, err
+// keyUsage only allows key encipherment for RSA, the only key type that can do it
+func keyUsage(key crypto.Signer) x509.KeyUsage {
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
 	}
+	return x509.KeyUsageDigitalSignature
+}
 
-	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
-		return nil, err
+// Leaf returns our own certificate, Init must have been called.
+func (t *Tofu) Leaf() (*x509.Certificate, error) {
+	if t.Certificate == nil || len(t.Certificate.Certificate) == 0 {
+		return nil, ErrorNoCertificateFound
 	}
 
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, err
+	if t.Certificate.Leaf != nil {
+		return t.Certificate.Leaf, nil
 	}
 
-	return &cert, nil
+	return x509.ParseCertificate(t.Certificate.Certificate[0])
 }
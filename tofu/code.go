@@ -0,0 +1,88 @@
+package tofu
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// CodeNameplates is how many numbers codes start with, the number is public
+// and only used to find the peer
+const CodeNameplates = 100
+
+// NewCode returns a one-time pairing code like 7-harbor-walnut.
+func NewCode() (string, error) {
+	parts := make([]string, 0, 3)
+
+	n, err := rand.Int(rand.Reader, big.NewInt(CodeNameplates))
+	if err != nil {
+		return "", err
+	}
+	parts = append(parts, strconv.FormatInt(n.Int64(), 10))
+
+	for range 2 {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeWords))))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, codeWords[i.Int64()])
+	}
+
+	return strings.Join(parts, "-"), nil
+}
+
+// Nameplate returns the public number a code starts with.
+func Nameplate(code string) (string, error) {
+	nameplate, words, ok := strings.Cut(code, "-")
+	if !ok || words == "" {
+		return "", fmt.Errorf("%w: %s", ErrorInvalidCode, code)
+	}
+
+	if _, err := strconv.ParseUint(nameplate, 10, 32); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrorInvalidCode, code)
+	}
+
+	return nameplate, nil
+}
+
+var codeWords = []string{
+	"acorn", "adrift", "agenda", "almond", "amber", "angle", "ankle", "apple",
+	"apron", "arcade", "arctic", "armor", "arrow", "artist", "aspen", "atlas",
+	"autumn", "avenue", "bacon", "badge", "bagel", "bamboo", "banjo",
+	"barley", "barn", "basket", "beacon", "bench", "berry", "bicycle",
+	"biscuit", "blanket", "blossom", "bonfire", "border", "bottle", "boulder",
+	"bracket", "brick", "bridge", "bronze", "bubble", "bucket", "buffalo",
+	"bundle", "butter", "button", "cabin", "cactus", "candle", "canoe",
+	"canvas", "canyon", "carpet", "carrot", "castle", "cedar", "cellar",
+	"cement", "cherry", "cider", "cinema", "circus", "citrus", "clover",
+	"cobalt", "coffee", "comet", "copper", "coral", "cotton", "cradle",
+	"crater", "crayon", "cricket", "crystal", "cupboard", "curtain",
+	"cushion", "dagger", "daisy", "dancer", "delta", "denim", "desert",
+	"diamond", "dinner", "dolphin", "donkey", "dragon", "drum", "eagle",
+	"easel", "elbow", "ember", "engine", "falcon", "feather", "fender",
+	"ferry", "fiddle", "fig", "flannel", "flute", "fossil", "fountain", "fox",
+	"galaxy", "garden", "garlic", "gazelle", "geyser", "ginger", "glacier",
+	"globe", "granite", "gravel", "guitar", "hammer", "harbor", "harvest",
+	"hazel", "helmet", "heron", "hickory", "honey", "husky", "igloo",
+	"island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw",
+	"jungle", "kayak", "kitten", "koala", "ladder", "lagoon", "lantern",
+	"lemon", "lily", "linen", "lizard", "lobster", "locket", "mango", "maple",
+	"marble", "meadow", "melon", "meteor", "mint", "mirror", "mitten",
+	"monsoon", "mosaic", "mustard", "napkin", "nectar", "needle", "nickel",
+	"noodle", "nutmeg", "oasis", "oatmeal", "octopus", "olive", "orbit",
+	"orchid", "otter", "oyster", "paddle", "palace", "panda", "pebble",
+	"pelican", "pencil", "pepper", "pickle", "pigeon", "pillow", "pine",
+	"pirate", "planet", "plaster", "plum", "pocket", "pony", "poppy",
+	"pretzel", "pumpkin", "puzzle", "quartz", "quill", "rabbit", "radar",
+	"radish", "raisin", "raven", "ribbon", "robin", "rocket", "saddle",
+	"saffron", "salmon", "sandal", "scarf", "seashell", "shadow", "shovel",
+	"silver", "sled", "sparrow", "spider", "spruce", "squash", "stable",
+	"starfish", "summit", "sunset", "swan", "tablet", "teapot", "thistle",
+	"thunder", "tiger", "timber", "toast", "tomato", "topaz", "torch",
+	"tractor", "trumpet", "tundra", "turnip", "turtle", "umbrella", "valley",
+	"velvet", "violin", "volcano", "waffle", "wagon", "walnut", "whistle",
+	"willow", "window", "winter", "wizard", "yogurt", "zebra", "zephyr",
+	"zipper",
+}
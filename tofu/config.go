@@ -2,24 +2,34 @@ package tofu
 
 import "crypto/tls"
 
+// DefaultServerConfig only refuses peers whose key changed, or that aren't
+// signed by CAs under PolicyCA. Connections must be wrapped with NewConn so
+// unknown peers are paired.
 func (t *Tofu) DefaultServerConfig() *tls.Config {
-	return &tls.Config{
-		Certificates: []tls.Certificate{*t.Certificate},
-		ClientAuth:   tls.RequireAnyClientCert,
-		VerifyConnection: func(cs tls.ConnectionState) error {
-			return t.verify(cs)
-		},
-		MinVersion: tls.VersionTLS12,
+	config := &tls.Config{
+		Certificates:     []tls.Certificate{*t.Certificate},
+		ClientAuth:       tls.RequireAnyClientCert,
+		VerifyConnection: t.verifier(""),
+		MinVersion:       tls.VersionTLS12,
+	}
+
+	// Verify each client with its own copy, so we know who is connecting
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.VerifyConnection = t.verifier(hello.Conn.RemoteAddr().String())
+		return c, nil
 	}
+
+	return config
 }
 
+// DefaultClientConfig is like DefaultServerConfig, for dialing.
 func (t *Tofu) DefaultClientConfig() *tls.Config {
 	return &tls.Config{
 		Certificates:       []tls.Certificate{*t.Certificate},
 		InsecureSkipVerify: true,
-		VerifyConnection: func(cs tls.ConnectionState) error {
-			return t.verify(cs)
-		},
-		MinVersion: tls.VersionTLS12,
+		VerifyConnection:   t.verifier(""),
+		MinVersion:         tls.VersionTLS12,
 	}
 }
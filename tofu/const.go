@@ -4,7 +4,49 @@ import "fmt"
 
 var (
 	ErrorConnectionDenied      error = fmt.Errorf("connection denied")
+	ErrorPeerDenied            error = fmt.Errorf("peer denied the connection")
 	ErrorNoCertificateProvided error = fmt.Errorf("no certificate provided")
 	ErrorNoCertificateFound    error = fmt.Errorf("no certificate found")
 	ErrorMustSpecifyCertPaths  error = fmt.Errorf("missing cert paths")
+	ErrorPeerKeyChanged        error = fmt.Errorf("peer key changed")
+	ErrorPeerNotTrusted        error = fmt.Errorf("peer not trusted")
+	ErrorInvalidFingerprint    error = fmt.Errorf("invalid fingerprint")
+	ErrorInvalidPeerID         error = fmt.Errorf("invalid peer id")
+	ErrorPeerAlreadyTrusted    error = fmt.Errorf("peer already trusted")
+	ErrorTrustDBVersion        error = fmt.Errorf("unsupported trust database version")
+	ErrorUnsupportedKey        error = fmt.Errorf("unsupported private key")
+	ErrorUnsupportedAlgorithm  error = fmt.Errorf("unsupported key algorithm")
+	ErrorInvalidRotation       error = fmt.Errorf("invalid rotation signature")
+	ErrorInvalidCode           error = fmt.Errorf("invalid pairing code")
+	ErrorCodeMismatch          error = fmt.Errorf("only one side is pairing with a code")
+	ErrorPairingFailed         error = fmt.Errorf("pairing failed, the codes don't match")
+	ErrorCodeBurned            error = fmt.Errorf("pairing code was already used in a failed attempt")
+	ErrorInvalidPolicy         error = fmt.Errorf("invalid trust policy")
+	ErrorNoCAs                 error = fmt.Errorf("no CA certificates")
+	ErrorNotSignedByCA         error = fmt.Errorf("peer certificate is not signed by a trusted CA")
+	ErrorCertMismatch          error = fmt.Errorf("certificate doesn't match our identity")
+	ErrorPeerBlocked           error = fmt.Errorf("peer is blocked")
+	ErrorPeerNotBlocked        error = fmt.Errorf("peer is not blocked")
+	ErrorCertRevoked           error = fmt.Errorf("peer certificate was revoked")
+	ErrorInvalidPermissions    error = fmt.Errorf("invalid permissions")
+	ErrorInvalidKeyFile        error = fmt.Errorf("invalid encrypted key file")
+	ErrorWrongPassphrase       error = fmt.Errorf("wrong passphrase")
+	ErrorPassphraseRequired    error = fmt.Errorf("private key is encrypted, a passphrase is required")
+	ErrorDuplicatePeer         error = fmt.Errorf("peer listed more than once")
 )
+
+// KeyChangedError is returned when a known peer presents a different key,
+// errors.Is(err, ErrorPeerKeyChanged) matches it.
+type KeyChangedError struct {
+	PeerID    string
+	Known     string
+	Presented string
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("%v: peer '%s' is pinned to %s but presented %s", ErrorPeerKeyChanged, e.PeerID, e.Known, e.Presented)
+}
+
+func (e *KeyChangedError) Is(target error) bool {
+	return target == ErrorPeerKeyChanged
+}
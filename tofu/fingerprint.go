@@ -1,37 +1,169 @@
 package tofu
 
 import (
-	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
-	"os"
-	"path/filepath"
+	"strings"
+	"time"
 )
 
-func (t *Tofu) trust(peerID string, cert []byte) error {
-	fingerprint := sha256.Sum256(cert)
-	prefixedFingerprint := t.format("sha256", fingerprint[:])
+// Trust files written before fingerprints were fixed all contain the hash of
+// nothing, they can't tell peers apart and are re-confirmed on next contact
+var legacyFingerprint = func() string {
+	sum := sha256.Sum256(nil)
+	return format("sha256", sum[:])
+}()
 
-	return os.WriteFile(filepath.Join(t.TrustPath, peerID), []byte(prefixedFingerprint), 0600)
+// Fingerprint returns the SHA-256 of the certificate's SubjectPublicKeyInfo,
+// so it identifies the key rather than the certificate wrapping it. It is
+// prefixed with the key's algorithm, e.g. ed25519:sha256:<hex>.
+func Fingerprint(cert *x509.Certificate) string {
+	return spkiFingerprint(cert.RawSubjectPublicKeyInfo)
 }
 
-func (t *Tofu) known(peerID string, cert []byte) (bool, error) {
-	storedFingerprint, err := os.ReadFile(filepath.Join(t.TrustPath, peerID))
-	if os.IsNotExist(err) {
-		return false, nil
+func spkiFingerprint(spki []byte) string {
+	sum := sha256.Sum256(spki)
+
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return format("sha256", sum[:])
+	}
+
+	return keyAlgorithm(pub, "") + ":" + format("sha256", sum[:])
+}
+
+// digest drops the algorithm prefix, fingerprints from before it was added
+// are only the digest
+func digest(fingerprint string) string {
+	parts := strings.Split(fingerprint, ":")
+	if len(parts) < 2 {
+		return fingerprint
+	}
+	return strings.Join(parts[len(parts)-2:], ":")
+}
+
+// sameFingerprint compares fingerprints of the same key with or without the
+// algorithm prefix
+func sameFingerprint(a, b string) bool {
+	return a == b || (a != "" && b != "" && digest(a) == digest(b))
+}
+
+// trust pins peerID to fingerprint, keeping what we already know about it
+func (t *Tofu) trust(peerID, fingerprint string) error {
+	if err := validPeerID(peerID); err != nil {
+		return err
 	}
+
+	return t.update(func(peers map[string]*Entry) error {
+		now := time.Now()
+
+		entry, ok := peers[peerID]
+		if !ok || entry.Fingerprint == legacyFingerprint {
+			entry = &Entry{
+				ID:        peerID,
+				FirstSeen: now,
+			}
+			peers[peerID] = entry
+		}
+
+		if !sameFingerprint(entry.Fingerprint, fingerprint) {
+			// Whatever the old key was, it isn't the one that was verified
+			entry.Algorithm = ""
+			entry.setFlag(FlagVerified, false)
+		}
+
+		entry.Fingerprint = fingerprint
+		entry.LastSeen = now
+		return nil
+	})
+}
+
+func (t *Tofu) known(peerID, fingerprint string) (bool, error) {
+	pinned, err := t.pinned(peerID)
 	if err != nil {
 		return false, err
 	}
 
-	fingerprint := sha256.Sum256(cert)
-	prefixedFingerprint := t.format("sha256", fingerprint[:])
+	return pinned != "" && sameFingerprint(pinned, fingerprint), nil
+}
+
+// pinned returns the fingerprint peerID is pinned to, or "" if it isn't pinned
+func (t *Tofu) pinned(peerID string) (string, error) {
+	entry, err := t.readEntry(peerID)
+	if err != nil || entry == nil {
+		return "", err
+	}
+
+	if entry.Fingerprint == legacyFingerprint {
+		return "", nil
+	}
+
+	return entry.Fingerprint, nil
+}
+
+// Replace re-pins an already trusted peer to a new fingerprint, this is the
+// only way to accept a changed key.
+func (t *Tofu) Replace(peerID, fingerprint string) error {
+	if err := validFingerprint(fingerprint); err != nil {
+		return err
+	}
+
+	if _, err := t.Entry(peerID); err != nil {
+		return err
+	}
+
+	if err := t.trust(peerID, fingerprint); err != nil {
+		return err
+	}
+
+	return t.SetFlag(peerID, FlagVerified, true)
+}
+
+// KeyAlgorithm names the certificate's key type, e.g. ecdsa-p256.
+func KeyAlgorithm(cert *x509.Certificate) string {
+	return keyAlgorithm(cert.PublicKey, strings.ToLower(cert.PublicKeyAlgorithm.String()))
+}
+
+func keyAlgorithm(pub any, fallback string) string {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.ReplaceAll(key.Curve.Params().Name, "-", ""))
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", key.N.BitLen())
+	case ed25519.PublicKey:
+		return "ed25519"
+	default:
+		return fallback
+	}
+}
+
+// validFingerprint accepts sha256:<hex>, optionally prefixed with the key's
+// algorithm
+func validFingerprint(fingerprint string) error {
+	prefix, digest, ok := strings.Cut(fingerprint, "sha256:")
+	if !ok || (prefix != "" && !validAlgorithmPrefix(prefix)) {
+		return fmt.Errorf("%w: %s", ErrorInvalidFingerprint, fingerprint)
+	}
+
+	raw, err := hex.DecodeString(digest)
+	if err != nil || len(raw) != sha256.Size {
+		return fmt.Errorf("%w: %s", ErrorInvalidFingerprint, fingerprint)
+	}
+
+	return nil
+}
 
-	return bytes.Equal([]byte(prefixedFingerprint), storedFingerprint), nil
+func validAlgorithmPrefix(prefix string) bool {
+	alg, ok := strings.CutSuffix(prefix, ":")
+	return ok && alg != "" && strings.Trim(alg, "abcdefghijklmnopqrstuvwxyz0123456789-") == ""
 }
 
-func (t *Tofu) format(a string, fingerprint []byte) string {
+func format(a string, fingerprint []byte) string {
 	hexFingerprint := hex.EncodeToString(fingerprint)
 	prefixedFingerprint := fmt.Sprintf("%s:%s", a, hexFingerprint)
 
@@ -0,0 +1,200 @@
+package tofu
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const encryptedKeyType = "GOBYTE ENCRYPTED PRIVATE KEY"
+
+// ScryptN is the scrypt cost used for new passphrases, existing keys keep
+// the cost they were written with
+var ScryptN = 1 << 15
+
+// PassphraseFunc returns the passphrase of our private key, it is only called
+// if the key is encrypted.
+type PassphraseFunc func() ([]byte, error)
+
+func deriveKey(passphrase, salt []byte, n int) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, n, 8, 1, 32)
+}
+
+func gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptKey seals a PKCS#8 key with a key derived from passphrase by scrypt
+func encryptKey(der, passphrase []byte) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, salt, ScryptN)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := gcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":   "scrypt",
+			"N":     strconv.Itoa(ScryptN),
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, der, []byte(encryptedKeyType)),
+	}, nil
+}
+
+// decryptKey returns the PKCS#8 key sealed by encryptKey
+func decryptKey(block *pem.Block, passphrase []byte) ([]byte, error) {
+	// Bound the cost, the file could make us allocate gigabytes
+	n, err := strconv.Atoi(block.Headers["N"])
+	if err != nil || n > 1<<22 || block.Headers["KDF"] != "scrypt" {
+		return nil, fmt.Errorf("%w: unknown key derivation", ErrorInvalidKeyFile)
+	}
+
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidKeyFile, err)
+	}
+
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidKeyFile, err)
+	}
+
+	key, err := deriveKey(passphrase, salt, n)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidKeyFile, err)
+	}
+
+	aead, err := gcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: bad nonce", ErrorInvalidKeyFile)
+	}
+
+	der, err := aead.Open(nil, nonce, block.Bytes, []byte(encryptedKeyType))
+	if err != nil {
+		return nil, ErrorWrongPassphrase
+	}
+
+	return der, nil
+}
+
+// encodeKey returns the key file contents for a PKCS#8 key, encrypted if we
+// have a passphrase
+func (t *Tofu) encodeKey(der []byte) ([]byte, error) {
+	if len(t.passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+
+	block, err := encryptKey(der, t.passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// loadKeyPair reads our certificate and key, asking for the passphrase if the
+// key is encrypted
+func (t *Tofu) loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block != nil && block.Type == encryptedKeyType {
+		if t.Passphrase == nil {
+			return tls.Certificate{}, ErrorPassphraseRequired
+		}
+
+		passphrase, err := t.Passphrase()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		der, err := decryptKey(block, passphrase)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		// Keys we write from now on are encrypted the same way
+		t.passphrase = passphrase
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Encrypted reports whether our private key is protected by a passphrase,
+// Init must have been called.
+func (t *Tofu) Encrypted() bool {
+	return len(t.passphrase) > 0
+}
+
+// SetPassphrase rewrites our private key encrypted with passphrase, an empty
+// one stores it unencrypted. Init must have been called.
+func (t *Tofu) SetPassphrase(passphrase []byte) error {
+	if t.Certificate == nil {
+		return ErrorNoCertificateFound
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(t.Certificate.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	previous := t.passphrase
+	t.passphrase = passphrase
+
+	keyPEM, err := t.encodeKey(der)
+	if err != nil {
+		t.passphrase = previous
+		return err
+	}
+
+	_, keyFile := t.certFiles()
+	if err := WriteFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		t.passphrase = previous
+		return err
+	}
+
+	return nil
+}
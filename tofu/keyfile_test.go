@@ -0,0 +1,76 @@
+package tofu
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestEncryptedKey(t *testing.T) {
+	defer func(n int) { ScryptN = n }(ScryptN)
+	ScryptN = 1 << 10
+
+	peer := newTestPeer(t, "peer")
+	fingerprint := Fingerprint(peer.Certificate.Leaf)
+
+	if err := peer.SetPassphrase([]byte("correct horse")); err != nil {
+		t.Fatalf("failed to set passphrase: %v", err)
+	}
+
+	_, keyFile := peer.certFiles()
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(encryptedKeyType)) || bytes.Contains(data, []byte("BEGIN PRIVATE KEY")) {
+		t.Fatal("expected the key file to be encrypted")
+	}
+
+	load := func(passphrase PassphraseFunc) (*Tofu, error) {
+		reloaded := &Tofu{ID: peer.ID, CertPath: peer.CertPath, Passphrase: passphrase}
+		cert, err := reloaded.cert()
+		if err != nil {
+			return nil, err
+		}
+		reloaded.Certificate = cert
+		return reloaded, nil
+	}
+
+	if _, err := load(nil); !errors.Is(err, ErrorPassphraseRequired) {
+		t.Errorf("expected ErrorPassphraseRequired, got: %v", err)
+	}
+
+	wrong := func() ([]byte, error) { return []byte("wrong"), nil }
+	if _, err := load(wrong); !errors.Is(err, ErrorWrongPassphrase) {
+		t.Errorf("expected ErrorWrongPassphrase, got: %v", err)
+	}
+
+	right := func() ([]byte, error) { return []byte("correct horse"), nil }
+	reloaded, err := load(right)
+	if err != nil {
+		t.Fatalf("failed to load the encrypted key: %v", err)
+	}
+	if Fingerprint(reloaded.Certificate.Leaf) != fingerprint || !reloaded.Encrypted() {
+		t.Error("expected the same, encrypted key back")
+	}
+
+	// A rotated key is encrypted with the same passphrase
+	if _, err := reloaded.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(wrong); !errors.Is(err, ErrorWrongPassphrase) {
+		t.Errorf("expected the rotated key to stay encrypted, got: %v", err)
+	}
+	if _, err := load(right); err != nil {
+		t.Errorf("failed to load the rotated key: %v", err)
+	}
+
+	// An empty passphrase removes the encryption
+	if err := reloaded.SetPassphrase(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(nil); err != nil {
+		t.Errorf("expected the key to load without a passphrase, got: %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package tofu
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sasExporterLabel  = "EXPORTER-gobyte-sas"
+	pakeExporterLabel = "EXPORTER-gobyte-pake"
+)
+
+// What each side needs from pairing, exchanged first
+const (
+	pairTrusted byte = iota
+	pairConfirm
+	pairCode
+)
+
+// PairTimeout bounds the pairing exchange, including the time the peer's
+// user takes to compare codes
+var PairTimeout = time.Minute * 2
+
+// Conn is a TLS connection that pairs with unknown peers before any data is
+// exchanged through it. Both sides show a short code derived from the session
+// and both keys, the peer is only trusted once the users on both ends confirm
+// it. The embedded tls.Conn skips pairing.
+type Conn struct {
+	*tls.Conn
+
+	t      *Tofu
+	addr   string
+	client bool
+
+	once sync.Once
+	err  error
+}
+
+// NewConn wraps a connection made with DefaultServerConfig or
+// DefaultClientConfig, unknown peers are refused until paired.
+func (t *Tofu) NewConn(conn *tls.Conn) *Conn {
+	return &Conn{
+		Conn: conn,
+		t:    t,
+		addr: conn.RemoteAddr().String(),
+	}
+}
+
+type listener struct {
+	net.Listener
+	t *Tofu
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.t.NewConn(conn.(*tls.Conn)), nil
+}
+
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the TLS handshake and pairs with the peer if it isn't trusted yet.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.once.Do(func() {
+		if c.err = c.Conn.HandshakeContext(ctx); c.err != nil {
+			return
+		}
+		c.err = c.pair()
+	})
+	return c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// pair runs after verify accepted the handshake, so the peer is either pinned
+// to the key it presented or not pinned at all.
+func (c *Conn) pair() error {
+	cs := c.ConnectionState()
+	if len(cs.PeerCertificates) == 0 {
+		return ErrorNoCertificateProvided
+	}
+
+	cert := cs.PeerCertificates[0]
+	peerID := cert.Subject.CommonName
+	fingerprint := Fingerprint(cert)
+
+	pinned, err := c.t.pinned(peerID)
+	if err != nil {
+		return err
+	}
+
+	mode := pairTrusted
+	switch {
+	case c.t.Code != "":
+		mode = pairCode
+	case c.t.caSigned(cs):
+		// Nothing to confirm, the CA vouches for the peer
+	case !sameFingerprint(pinned, fingerprint):
+		mode = pairConfirm
+	}
+
+	c.SetDeadline(time.Now().Add(PairTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	// Tell each other how we want to pair, with the one-time code or
+	// whose user has to confirm the short code
+	theirs, err := c.exchange([]byte{mode})
+	if err != nil {
+		return err
+	}
+	theirMode := theirs[0]
+
+	if (mode == pairCode) != (theirMode == pairCode) {
+		return ErrorCodeMismatch
+	}
+	if mode == pairCode {
+		return c.pairCode(cs, cert)
+	}
+
+	// The side that already trusts the other still shows the short code to
+	// compare against
+	confirm := mode == pairConfirm
+	if !confirm && theirMode != pairConfirm {
+		return nil
+	}
+
+	code, err := c.t.code(cs, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	accepted := true
+	if confirm {
+		accepted = c.t.OnNewPeer(peerID, fingerprint, code)
+	} else if c.t.OnShowCode != nil {
+		c.t.OnShowCode(peerID, code)
+	}
+
+	verdict := []byte{0}
+	if accepted {
+		verdict[0] = 1
+	}
+
+	theirVerdict, err := c.exchange(verdict)
+	if err != nil {
+		return err
+	}
+
+	if !accepted {
+		return ErrorConnectionDenied
+	}
+	if theirVerdict[0] != 1 {
+		return ErrorPeerDenied
+	}
+
+	if !confirm {
+		return nil
+	}
+
+	return c.pin(cert)
+}
+
+// pairCode runs SPAKE2 with the one-time code, bound to this TLS session and
+// both keys. The code is burned once our message is sent, whatever the
+// outcome, so each code is good for a single guess.
+func (c *Conn) pairCode(cs tls.ConnectionState, cert *x509.Certificate) error {
+	if c.t.codeBurned.Load() {
+		return ErrorCodeBurned
+	}
+
+	ekm, err := cs.ExportKeyingMaterial(pakeExporterLabel, nil, 32)
+	if err != nil {
+		return err
+	}
+
+	ours, err := c.t.Leaf()
+	if err != nil {
+		return err
+	}
+
+	clientCert, serverCert := ours, cert
+	if !c.client {
+		clientCert, serverCert = cert, ours
+	}
+
+	pake, err := newSpake2(c.t.Code, c.client)
+	if err != nil {
+		return err
+	}
+
+	if !c.t.codeBurned.CompareAndSwap(false, true) {
+		return ErrorCodeBurned
+	}
+
+	theirs, err := c.exchange(pake.msg)
+	if err != nil {
+		return err
+	}
+
+	key, err := pake.finish(theirs, ekm, clientCert.RawSubjectPublicKeyInfo, serverCert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return err
+	}
+
+	theirConfirmation, err := c.exchange(confirmation(key, c.client))
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(theirConfirmation, confirmation(key, !c.client)) {
+		return ErrorPairingFailed
+	}
+
+	return c.pin(cert)
+}
+
+// pin trusts the peer we just paired with
+func (c *Conn) pin(cert *x509.Certificate) error {
+	peerID := cert.Subject.CommonName
+
+	if err := c.t.trust(peerID, Fingerprint(cert)); err != nil {
+		return err
+	}
+	if err := c.t.SetFlag(peerID, FlagVerified, true); err != nil {
+		return err
+	}
+
+	return c.t.seen(peerID, cert, c.addr)
+}
+
+// exchange sends ours and reads as many bytes back at the same time, both
+// sides do the same so neither waits on the other to read first
+func (c *Conn) exchange(ours []byte) ([]byte, error) {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Conn.Write(ours)
+		errc <- err
+	}()
+
+	theirs := make([]byte, len(ours))
+	_, err := io.ReadFull(c.Conn, theirs)
+	if werr := <-errc; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pairing failed: %w", err)
+	}
+
+	return theirs, nil
+}
+
+// code is the short authentication string both users compare. It depends on
+// the TLS session, so a man in the middle ends up with different codes on
+// each side.
+func (t *Tofu) code(cs tls.ConnectionState, peerFingerprint string) (string, error) {
+	ekm, err := cs.ExportKeyingMaterial(sasExporterLabel, nil, 32)
+	if err != nil {
+		return "", err
+	}
+
+	ours, err := t.Leaf()
+	if err != nil {
+		return "", err
+	}
+
+	// Only the digests, so versions that don't prefix the algorithm agree
+	fingerprints := []string{digest(Fingerprint(ours)), digest(peerFingerprint)}
+	sort.Strings(fingerprints)
+
+	h := sha256.New()
+	h.Write(ekm)
+	for _, fp := range fingerprints {
+		h.Write([]byte(fp))
+	}
+
+	n := binary.BigEndian.Uint32(h.Sum(nil)) % 1000000
+	return fmt.Sprintf("%03d %03d", n/1000, n%1000), nil
+}
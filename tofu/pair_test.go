@@ -0,0 +1,232 @@
+package tofu
+
+import (
+	"crypto/x509"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func newTestPeer(t *testing.T, id string) *Tofu {
+	t.Helper()
+	return newTestPeerWith(t, id, "")
+}
+
+type pairResult struct {
+	serverErr  error
+	clientErr  error
+	clientAddr string
+	serverAddr string
+}
+
+// connect dials server from client and handshakes both ends
+func connect(t *testing.T, server, client *Tofu) pairResult {
+	t.Helper()
+
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- conn.(*Conn).Handshake()
+	}()
+
+	res := pairResult{serverAddr: ln.Addr().String()}
+
+	conn, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		res.clientErr = err
+	} else {
+		res.clientAddr = conn.LocalAddr().String()
+		res.clientErr = conn.Handshake()
+		conn.Close()
+	}
+
+	res.serverErr = <-done
+	return res
+}
+
+func TestPairing(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+
+	// Both sides prompt at the same time
+	var mu sync.Mutex
+	var codes []string
+	onNewPeer := func(id, fingerprint, code string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		codes = append(codes, code)
+		return true
+	}
+	server.OnNewPeer = onNewPeer
+	client.OnNewPeer = onNewPeer
+
+	res := connect(t, server, client)
+	if res.serverErr != nil || res.clientErr != nil {
+		t.Fatalf("expected pairing to succeed, got %v, %v", res.serverErr, res.clientErr)
+	}
+
+	if len(codes) != 2 || codes[0] != codes[1] || len(codes[0]) != len("123 456") {
+		t.Fatalf("expected both sides to be shown the same code, got: %v", codes)
+	}
+
+	entry, err := client.Entry("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.HasFlag(FlagVerified) || entry.LastAddr != res.serverAddr || entry.Algorithm != "ecdsa-p256" {
+		t.Errorf("unexpected entry after pairing: %+v", entry)
+	}
+
+	entry, err = server.Entry("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.LastAddr != res.clientAddr {
+		t.Errorf("expected server to record %s, got %s", res.clientAddr, entry.LastAddr)
+	}
+
+	// Paired peers connect without prompting again
+	codes = nil
+	res = connect(t, server, client)
+	if res.serverErr != nil || res.clientErr != nil {
+		t.Fatalf("expected paired peers to connect, got %v, %v", res.serverErr, res.clientErr)
+	}
+	if len(codes) != 0 {
+		t.Errorf("expected no prompts for paired peers, got: %v", codes)
+	}
+}
+
+func TestPairingOneSided(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+
+	// The client already trusts the server, only the server's user confirms
+	if err := client.trust("server", Fingerprint(leaf(t, server))); err != nil {
+		t.Fatal(err)
+	}
+
+	var prompted, shown string
+	server.OnNewPeer = func(id, fingerprint, code string) bool {
+		prompted = code
+		return true
+	}
+	client.OnNewPeer = func(id, fingerprint, code string) bool {
+		t.Error("expected no prompt on the side that already trusts its peer")
+		return true
+	}
+	client.OnShowCode = func(id, code string) {
+		shown = code
+	}
+
+	res := connect(t, server, client)
+	if res.serverErr != nil || res.clientErr != nil {
+		t.Fatalf("expected pairing to succeed, got %v, %v", res.serverErr, res.clientErr)
+	}
+
+	if prompted == "" || prompted != shown {
+		t.Errorf("expected the trusting side to show the code being confirmed, got %q and %q", prompted, shown)
+	}
+}
+
+func TestPairingDenied(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+
+	server.OnNewPeer = func(id, fingerprint, code string) bool {
+		return false
+	}
+
+	res := connect(t, server, client)
+	if !errors.Is(res.serverErr, ErrorConnectionDenied) {
+		t.Errorf("expected ErrorConnectionDenied on the denying side, got: %v", res.serverErr)
+	}
+	if !errors.Is(res.clientErr, ErrorPeerDenied) {
+		t.Errorf("expected ErrorPeerDenied on the denied side, got: %v", res.clientErr)
+	}
+
+	// Trust needs both sides to confirm
+	for _, tofu := range []*Tofu{server, client} {
+		entries, err := tofu.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("expected nothing to be trusted, got: %+v", entries)
+		}
+	}
+}
+
+func TestPairingCodesDifferPerSession(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+
+	var codes []string
+	client.OnNewPeer = func(id, fingerprint, code string) bool {
+		codes = append(codes, code)
+		return false
+	}
+
+	connect(t, server, client)
+	connect(t, server, client)
+
+	if len(codes) != 2 || codes[0] == codes[1] {
+		t.Errorf("expected a fresh code per session, got: %v", codes)
+	}
+}
+
+func TestSkipPairingOnRawConn(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+
+	client.OnNewPeer = func(id, fingerprint, code string) bool {
+		t.Error("expected no prompt before the wrapped conn is used")
+		return true
+	}
+
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*Conn).Conn.Write([]byte{42})
+	}()
+
+	conn, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b := make([]byte, 1)
+	if _, err := conn.Conn.Read(b); err != nil || b[0] != 42 {
+		t.Errorf("expected raw read before pairing, got %v, %v", b, err)
+	}
+}
+
+func leaf(t *testing.T, tofu *Tofu) *x509.Certificate {
+	t.Helper()
+
+	cert, err := x509.ParseCertificate(tofu.Certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,137 @@
+package tofu
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"filippo.io/edwards25519"
+)
+
+// SPAKE2 (RFC 9382) over edwards25519, so two peers that know the same
+// one-time code authenticate each other without revealing it. A wrong guess
+// costs a whole connection, the code can't be checked offline.
+
+const pakeLabel = "gobyte-spake2"
+
+var (
+	pakeM = hashToPoint(pakeLabel + " M")
+	pakeN = hashToPoint(pakeLabel + " N")
+)
+
+// hashToPoint finds a point nobody knows the discrete log of by hashing until
+// the result decodes, with its small order component cleared
+func hashToPoint(seed string) *edwards25519.Point {
+	for i := 0; ; i++ {
+		sum := sha256.Sum256(fmt.Appendf(nil, "%s %d", seed, i))
+
+		p, err := new(edwards25519.Point).SetBytes(sum[:])
+		if err != nil {
+			continue
+		}
+
+		p.MultByCofactor(p)
+		if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+
+		return p
+	}
+}
+
+type spake2 struct {
+	client bool
+	w      *edwards25519.Scalar
+	x      *edwards25519.Scalar
+	msg    []byte
+}
+
+func newSpake2(code string, client bool) (*spake2, error) {
+	seed := make([]byte, 64)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+
+	x, err := edwards25519.NewScalar().SetUniformBytes(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha512.Sum512([]byte(pakeLabel + " " + code))
+	w, err := edwards25519.NewScalar().SetUniformBytes(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The client blinds with M and the server with N
+	blind := pakeN
+	if client {
+		blind = pakeM
+	}
+
+	msg := new(edwards25519.Point).ScalarBaseMult(x)
+	msg.Add(msg, new(edwards25519.Point).ScalarMult(w, blind))
+
+	return &spake2{
+		client: client,
+		w:      w,
+		x:      x,
+		msg:    msg.Bytes(),
+	}, nil
+}
+
+// finish returns the key both sides share if they used the same code, bound
+// to context so it can't be reused elsewhere
+func (s *spake2) finish(theirs []byte, context ...[]byte) ([]byte, error) {
+	peer, err := new(edwards25519.Point).SetBytes(theirs)
+	if err != nil {
+		return nil, ErrorPairingFailed
+	}
+
+	unblind := pakeM
+	if s.client {
+		unblind = pakeN
+	}
+
+	k := new(edwards25519.Point).ScalarMult(s.w, unblind)
+	k.Subtract(peer, k)
+	k.ScalarMult(s.x, k)
+	k.MultByCofactor(k)
+
+	if k.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, ErrorPairingFailed
+	}
+
+	clientMsg, serverMsg := s.msg, theirs
+	if !s.client {
+		clientMsg, serverMsg = theirs, s.msg
+	}
+
+	h := sha256.New()
+	for _, b := range append([][]byte{clientMsg, serverMsg, k.Bytes(), s.w.Bytes()}, context...) {
+		writePrefixed(h, b)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// confirmation proves to the peer that we derived the same key
+func confirmation(key []byte, client bool) []byte {
+	role := "server"
+	if client {
+		role = "client"
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pakeLabel + " confirm " + role))
+	return mac.Sum(nil)
+}
+
+func writePrefixed(h hash.Hash, b []byte) {
+	binary.Write(h, binary.LittleEndian, uint64(len(b)))
+	h.Write(b)
+}
@@ -0,0 +1,206 @@
+package tofu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"regexp"
+	"testing"
+)
+
+func TestSpake2(t *testing.T) {
+	run := func(clientCode, serverCode string) ([]byte, []byte) {
+		client, err := newSpake2(clientCode, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := newSpake2(serverCode, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clientKey, err := client.finish(server.msg, []byte("session"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverKey, err := server.finish(client.msg, []byte("session"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return clientKey, serverKey
+	}
+
+	clientKey, serverKey := run("7-harbor-walnut", "7-harbor-walnut")
+	if !bytes.Equal(clientKey, serverKey) {
+		t.Error("expected the same code to give the same key")
+	}
+
+	clientKey, serverKey = run("7-harbor-walnut", "7-harbor-comet")
+	if bytes.Equal(clientKey, serverKey) {
+		t.Error("expected different codes to give different keys")
+	}
+
+	client, err := newSpake2("7-harbor-walnut", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.finish(make([]byte, 31)); !errors.Is(err, ErrorPairingFailed) {
+		t.Errorf("expected a malformed message to fail, got: %v", err)
+	}
+}
+
+func TestNewCode(t *testing.T) {
+	if len(codeWords) != 256 {
+		t.Errorf("expected 256 code words, got %d", len(codeWords))
+	}
+
+	format := regexp.MustCompile(`^[0-9]{1,2}-[a-z]+-[a-z]+$`)
+	for range 20 {
+		code, err := NewCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(code) {
+			t.Errorf("unexpected code format: %s", code)
+		}
+
+		if _, err := Nameplate(code); err != nil {
+			t.Errorf("expected %s to have a nameplate, got: %v", code, err)
+		}
+	}
+
+	for _, code := range []string{"", "7", "7-", "harbor-walnut", "-harbor"} {
+		if _, err := Nameplate(code); !errors.Is(err, ErrorInvalidCode) {
+			t.Errorf("expected ErrorInvalidCode for %q, got: %v", code, err)
+		}
+	}
+}
+
+func TestPairingWithCode(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+	server.Code = "7-harbor-walnut"
+	client.Code = "7-harbor-walnut"
+
+	prompt := func(id, fingerprint, code string) bool {
+		t.Error("expected no prompt when pairing with a code")
+		return false
+	}
+	server.OnNewPeer = prompt
+	client.OnNewPeer = prompt
+
+	res := connect(t, server, client)
+	if res.serverErr != nil || res.clientErr != nil {
+		t.Fatalf("expected pairing to succeed, got %v, %v", res.serverErr, res.clientErr)
+	}
+
+	for _, p := range []struct {
+		tofu *Tofu
+		peer string
+	}{{server, "client"}, {client, "server"}} {
+		entry, err := p.tofu.Entry(p.peer)
+		if err != nil {
+			t.Fatalf("expected %s to be pinned: %v", p.peer, err)
+		}
+		if !entry.HasFlag(FlagVerified) {
+			t.Errorf("expected %s to be marked verified", p.peer)
+		}
+	}
+
+	other := newTestPeer(t, "other")
+	other.Code = server.Code
+	res = connect(t, server, other)
+	if !errors.Is(res.serverErr, ErrorCodeBurned) {
+		t.Errorf("expected ErrorCodeBurned after pairing, got: %v", res.serverErr)
+	}
+}
+
+func TestPairingWithWrongCode(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+	server.Code = "7-harbor-walnut"
+	client.Code = "7-harbor-comet"
+
+	res := connect(t, server, client)
+	if !errors.Is(res.serverErr, ErrorPairingFailed) || !errors.Is(res.clientErr, ErrorPairingFailed) {
+		t.Fatalf("expected pairing to fail on both sides, got %v, %v", res.serverErr, res.clientErr)
+	}
+
+	entries, err := server.Entries()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing to be trusted, got %+v, %v", entries, err)
+	}
+
+	// One guess per code, even the right one is refused afterwards
+	client.Code = server.Code
+	res = connect(t, server, client)
+	if !errors.Is(res.serverErr, ErrorCodeBurned) {
+		t.Errorf("expected ErrorCodeBurned after a failed attempt, got: %v", res.serverErr)
+	}
+}
+
+func TestPairingCodeOnOneSide(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+	server.Code = "7-harbor-walnut"
+
+	res := connect(t, server, client)
+	if !errors.Is(res.serverErr, ErrorCodeMismatch) || !errors.Is(res.clientErr, ErrorCodeMismatch) {
+		t.Errorf("expected ErrorCodeMismatch on both sides, got %v, %v", res.serverErr, res.clientErr)
+	}
+}
+
+func TestPairingCodeBurnedOnHangUp(t *testing.T) {
+	server := newTestPeer(t, "server")
+	client := newTestPeer(t, "client")
+	server.Code = "7-harbor-walnut"
+
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- conn.(*Conn).Handshake()
+	}()
+
+	conn, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Guess, read the server's confirmation and hang up before answering it
+	raw := conn.Conn
+	pake, err := newSpake2("7-harbor-comet", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Write(append([]byte{pairCode}, pake.msg...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1+len(pake.msg)+sha256.Size)
+	if _, err := io.ReadFull(raw, buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if err := <-done; err == nil {
+		t.Fatal("expected pairing to fail on the server")
+	}
+
+	client.Code = server.Code
+	res := connect(t, server, client)
+	if !errors.Is(res.serverErr, ErrorCodeBurned) {
+		t.Errorf("expected ErrorCodeBurned after a hang up, got: %v", res.serverErr)
+	}
+}
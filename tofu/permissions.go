@@ -0,0 +1,114 @@
+package tofu
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Permissions are what a trusted peer may do when sending to us. The zero
+// value asks about every transfer and restricts nothing.
+type Permissions struct {
+	// AutoAccept skips the prompt for transfers within the other limits
+	AutoAccept bool `json:"auto_accept,omitempty"`
+	// MaxBytes caps a single transfer, 0 is unlimited
+	MaxBytes uint64 `json:"max_bytes,omitempty"`
+	// AllowedTypes are file extensions like ".jpg", empty allows any
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+	// Subdir is where the peer's files go, relative to the destination
+	Subdir string `json:"subdir,omitempty"`
+	// AllowedDirs are the directories under Subdir the peer may write into,
+	// empty allows any
+	AllowedDirs []string `json:"allowed_dirs,omitempty"`
+}
+
+// localPath refuses absolute paths and paths leaving the directory they are
+// relative to
+func localPath(path string) error {
+	if path != "" && !filepath.IsLocal(path) {
+		return fmt.Errorf("%w: %q must be a relative path inside the destination", ErrorInvalidPermissions, path)
+	}
+	return nil
+}
+
+func (p *Permissions) validate() error {
+	if err := localPath(p.Subdir); err != nil {
+		return err
+	}
+
+	for _, dir := range p.AllowedDirs {
+		if err := localPath(dir); err != nil {
+			return err
+		}
+	}
+
+	for _, ext := range p.AllowedTypes {
+		if !strings.HasPrefix(ext, ".") || strings.ContainsAny(ext, `/\`) {
+			return fmt.Errorf("%w: %q is not an extension like .jpg", ErrorInvalidPermissions, ext)
+		}
+	}
+
+	return nil
+}
+
+// AllowsSize reports whether a transfer of size bytes is within MaxBytes.
+func (p *Permissions) AllowsSize(size uint64) bool {
+	return p.MaxBytes == 0 || size <= p.MaxBytes
+}
+
+// AllowsType reports whether a file named name has one of AllowedTypes.
+func (p *Permissions) AllowsType(name string) bool {
+	if len(p.AllowedTypes) == 0 {
+		return true
+	}
+
+	ext := filepath.Ext(name)
+	return slices.ContainsFunc(p.AllowedTypes, func(allowed string) bool {
+		return strings.EqualFold(allowed, ext)
+	})
+}
+
+// AllowsDir reports whether dir, relative to Subdir, is one of AllowedDirs or
+// inside one of them.
+func (p *Permissions) AllowsDir(dir string) bool {
+	if len(p.AllowedDirs) == 0 {
+		return true
+	}
+
+	dir = filepath.Clean(dir)
+	return slices.ContainsFunc(p.AllowedDirs, func(allowed string) bool {
+		allowed = filepath.Clean(allowed)
+		return allowed == "." || dir == allowed || strings.HasPrefix(dir, allowed+string(filepath.Separator))
+	})
+}
+
+// SetPermissions replaces a trusted peer's permissions.
+func (t *Tofu) SetPermissions(peerID string, p Permissions) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	return t.modify(peerID, func(entry *Entry) {
+		if p.isZero() {
+			entry.Permissions = nil
+			return
+		}
+		entry.Permissions = &p
+	})
+}
+
+// Permissions returns a peer's permissions, the zero value if it has none or
+// isn't pinned, like peers a CA vouches for.
+func (t *Tofu) Permissions(peerID string) (Permissions, error) {
+	entry, err := t.readEntry(peerID)
+	if err != nil || entry == nil || entry.Permissions == nil {
+		return Permissions{}, err
+	}
+
+	return *entry.Permissions, nil
+}
+
+func (p *Permissions) isZero() bool {
+	return !p.AutoAccept && p.MaxBytes == 0 && len(p.AllowedTypes) == 0 && p.Subdir == "" && len(p.AllowedDirs) == 0
+}
@@ -0,0 +1,91 @@
+package tofu
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	p := Permissions{
+		MaxBytes:     100,
+		AllowedTypes: []string{".jpg", ".png"},
+		AllowedDirs:  []string{"photos", "shared/inbox"},
+	}
+
+	if !p.AllowsSize(100) || p.AllowsSize(101) {
+		t.Error("expected MaxBytes to be inclusive")
+	}
+
+	for name, want := range map[string]bool{"a.jpg": true, "b.PNG": true, "c.exe": false, "jpg": false} {
+		if got := p.AllowsType(name); got != want {
+			t.Errorf("AllowsType(%q) = %v, expected %v", name, got, want)
+		}
+	}
+
+	for dir, want := range map[string]bool{
+		"photos":         true,
+		"photos/2024":    true,
+		"photosynthesis": false,
+		"shared":         false,
+		"shared/inbox/x": true,
+		".":              false,
+	} {
+		if got := p.AllowsDir(dir); got != want {
+			t.Errorf("AllowsDir(%q) = %v, expected %v", dir, got, want)
+		}
+	}
+
+	var none Permissions
+	if !none.AllowsSize(1<<40) || !none.AllowsType("x.exe") || !none.AllowsDir("anywhere") {
+		t.Error("expected the zero value to restrict nothing")
+	}
+}
+
+func TestSetPermissions(t *testing.T) {
+	tofu := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	if err := tofu.Add("peer", "sha256:"+strings.Repeat("ab", 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []Permissions{
+		{Subdir: "../outside"},
+		{Subdir: "/etc"},
+		{AllowedDirs: []string{"ok", "../nope"}},
+		{AllowedTypes: []string{"jpg"}},
+	} {
+		if err := tofu.SetPermissions("peer", bad); !errors.Is(err, ErrorInvalidPermissions) {
+			t.Errorf("expected ErrorInvalidPermissions for %+v, got: %v", bad, err)
+		}
+	}
+
+	want := Permissions{AutoAccept: true, Subdir: "from-peer"}
+	if err := tofu.SetPermissions("peer", want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := tofu.Permissions("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.AutoAccept || got.Subdir != "from-peer" {
+		t.Errorf("unexpected permissions: %+v", got)
+	}
+
+	if err := tofu.SetPermissions("unknown", want); !errors.Is(err, ErrorPeerNotTrusted) {
+		t.Errorf("expected ErrorPeerNotTrusted, got: %v", err)
+	}
+
+	// Peers without an entry get the zero value
+	if got, err := tofu.Permissions("unknown"); err != nil || got.AutoAccept {
+		t.Errorf("expected no permissions for an unknown peer, got %+v, %v", got, err)
+	}
+
+	if err := tofu.SetPermissions("peer", Permissions{}); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := tofu.Entry("peer"); entry.Permissions != nil {
+		t.Error("expected resetting permissions to drop them")
+	}
+}
@@ -0,0 +1,276 @@
+package tofu
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const rotationLabel = "gobyte-rotation"
+
+var (
+	// rotationOID marks the certificate extension carrying our rotation
+	// statements, it is unregistered and only meaningful to gobyte
+	rotationOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 65535, 1, 1}
+
+	// MaxRotations is how many past rotations our certificate carries, peers
+	// that missed more than that have to re-pin us manually
+	MaxRotations = 8
+)
+
+// Rotation is a statement signed by a retired key that names the key
+// replacing it.
+type Rotation struct {
+	ID        string    `json:"id"`
+	OldKey    []byte    `json:"old_key"`
+	New       string    `json:"new"`
+	Time      time.Time `json:"time"`
+	Signature []byte    `json:"signature"`
+}
+
+// From is the fingerprint of the retired key.
+func (r *Rotation) From() string {
+	return spkiFingerprint(r.OldKey)
+}
+
+func (r *Rotation) message() []byte {
+	msg := []byte(rotationLabel)
+	for _, field := range [][]byte{[]byte(r.ID), r.OldKey, []byte(r.New)} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(field)))
+		msg = append(msg, field...)
+	}
+	return binary.BigEndian.AppendUint64(msg, uint64(r.Time.Unix()))
+}
+
+func (r *Rotation) verify() error {
+	pub, err := x509.ParsePKIXPublicKey(r.OldKey)
+	if err != nil {
+		return err
+	}
+
+	msg := r.message()
+	digest := sha256.Sum256(msg)
+
+	var ok bool
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], r.Signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, msg, r.Signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], r.Signature) == nil
+	default:
+		return ErrorUnsupportedKey
+	}
+
+	if !ok {
+		return ErrorInvalidRotation
+	}
+	return nil
+}
+
+func sign(key crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(msg)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func (t *Tofu) rotationFile() string {
+	return filepath.Join(t.CertPath, t.ID+".rotations")
+}
+
+// rotations are ours, oldest first
+func (t *Tofu) rotations() ([]*Rotation, error) {
+	data, err := os.ReadFile(t.rotationFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rotations []*Rotation
+	if err := json.Unmarshal(data, &rotations); err != nil {
+		return nil, fmt.Errorf("failed to read rotations: %w", err)
+	}
+
+	return rotations, nil
+}
+
+func rotationExtension(rotations []*Rotation) ([]pkix.Extension, error) {
+	if len(rotations) == 0 {
+		return nil, nil
+	}
+
+	value, err := json.Marshal(rotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return []pkix.Extension{{Id: rotationOID, Value: value}}, nil
+}
+
+// certRotations returns the rotation statements cert carries, if any
+func certRotations(cert *x509.Certificate) []*Rotation {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(rotationOID) {
+			continue
+		}
+
+		var rotations []*Rotation
+		if err := json.Unmarshal(ext.Value, &rotations); err != nil {
+			return nil
+		}
+		return rotations
+	}
+
+	return nil
+}
+
+// followRotations returns the signed rotations leading from the pinned key to
+// the one cert presents, or nil if there is no such chain
+func followRotations(peerID, pinned string, cert *x509.Certificate) []*Rotation {
+	current := pinned
+	var steps []*Rotation
+
+	for _, r := range certRotations(cert) {
+		// Rotations from before we pinned the peer don't matter
+		if r.ID != peerID || !sameFingerprint(r.From(), current) {
+			continue
+		}
+
+		if r.verify() != nil {
+			return nil
+		}
+
+		steps = append(steps, r)
+		current = r.New
+	}
+
+	if len(steps) == 0 || !sameFingerprint(current, Fingerprint(cert)) {
+		return nil
+	}
+
+	return steps
+}
+
+// Rotate replaces our key with a new one and signs a statement with the old
+// key, so peers that pinned it follow to the new one without prompting. The
+// new key is of Algorithm if set, or of the same type as the old one.
+func (t *Tofu) Rotate() (*Rotation, error) {
+	old, ok := t.Certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrorUnsupportedKey
+	}
+
+	leaf, err := t.Leaf()
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := t.Algorithm
+	if algorithm == "" {
+		algorithm = KeyAlgorithm(leaf)
+	}
+
+	key, err := generateKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	spki, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	rotation := &Rotation{
+		ID:     t.ID,
+		OldKey: leaf.RawSubjectPublicKeyInfo,
+		New:    spkiFingerprint(spki),
+		Time:   time.Now().UTC().Truncate(time.Second),
+	}
+
+	rotation.Signature, err = sign(old, rotation.message())
+	if err != nil {
+		return nil, err
+	}
+
+	rotations, err := t.rotations()
+	if err != nil {
+		return nil, err
+	}
+
+	rotations = append(rotations, rotation)
+	if len(rotations) > MaxRotations {
+		rotations = rotations[len(rotations)-MaxRotations:]
+	}
+
+	data, err := json.MarshalIndent(rotations, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	certDER, err := t.issue(key, rotations)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rotations go with the new key, a crash can't leave us with one
+	// and not the other
+	cert, err := t.writeCert(certDER, key, map[string][]byte{t.rotationFile(): data})
+	if err != nil {
+		return nil, err
+	}
+
+	t.Certificate = cert
+	return rotation, nil
+}
+
+// writeCert saves a certificate and its key, encrypted if ours is, together
+// with extra files that have to change along with them
+func (t *Tofu) writeCert(certDER []byte, key crypto.Signer, extra map[string][]byte) (*tls.Certificate, error) {
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFilePEM, err := t.encodeKey(privDER)
+	if err != nil {
+		return nil, err
+	}
+
+	certFile, keyFile := t.certFiles()
+	files := map[string][]byte{certFile: certPEM, keyFile: keyFilePEM}
+	maps.Copy(files, extra)
+
+	if err := t.writeFiles(files); err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
@@ -0,0 +1,204 @@
+package tofu
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotate(t *testing.T) {
+	peer := newTestPeer(t, "peer")
+	original, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	if err := verifier.Add("peer", Fingerprint(original)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two rotations, the verifier only ever saw the original key
+	for range 2 {
+		if _, err := peer.Rotate(); err != nil {
+			t.Fatalf("failed to rotate: %v", err)
+		}
+	}
+
+	rotated, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(rotated) == Fingerprint(original) {
+		t.Fatal("expected rotation to change the key")
+	}
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{rotated}}
+	if err := verifier.verify(state, ""); err != nil {
+		t.Fatalf("expected a signed rotation to be accepted, got: %v", err)
+	}
+
+	entry, err := verifier.Entry("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Fingerprint != Fingerprint(rotated) {
+		t.Error("expected the pin to follow the rotation")
+	}
+	if len(entry.Rotations) != 2 || entry.Rotations[0].From != Fingerprint(original) || entry.Rotations[1].To != Fingerprint(rotated) {
+		t.Errorf("expected both rotations to be recorded, got: %+v", entry.Rotations)
+	}
+	if !entry.HasFlag(FlagVerified) {
+		t.Error("expected a rotation to keep the peer verified")
+	}
+
+	// Renewing keeps presenting the rotations
+	peer.Certificate, err = peer.renew(peer.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certRotations(renewed)) != 2 {
+		t.Error("expected the renewed certificate to carry the rotations")
+	}
+}
+
+func TestForgedRotation(t *testing.T) {
+	peer := newTestPeer(t, "peer")
+	original, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else's key signs a rotation for the peer
+	impostor := newTestPeer(t, "peer")
+	if _, err := impostor.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	forged, err := impostor.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	if err := verifier.Add("peer", Fingerprint(original)); err != nil {
+		t.Fatal(err)
+	}
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{forged}}
+	if err := verifier.verify(state, ""); !errors.Is(err, ErrorPeerKeyChanged) {
+		t.Errorf("expected ErrorPeerKeyChanged for a rotation from another key, got: %v", err)
+	}
+
+	// A rotation with a tampered signature
+	rotations := certRotations(forged)
+	rotations[0].OldKey = original.RawSubjectPublicKeyInfo
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := impostor.issue(key, rotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state = tls.ConnectionState{PeerCertificates: []*x509.Certificate{tampered}}
+	if err := verifier.verify(state, ""); !errors.Is(err, ErrorPeerKeyChanged) {
+		t.Errorf("expected ErrorPeerKeyChanged for a tampered rotation, got: %v", err)
+	}
+
+	if pinned, _ := verifier.pinned("peer"); pinned != Fingerprint(original) {
+		t.Error("expected the pin to be unchanged")
+	}
+}
+
+// rotateStaged stages a rotation of peer's key without moving it into place
+func rotateStaged(t *testing.T, peer *Tofu) string {
+	t.Helper()
+
+	key, err := generateKey(peer.Algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := peer.issue(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := peer.certFiles()
+	err = peer.stageFiles(map[string][]byte{
+		certFile:            pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		keyFile:             pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}),
+		peer.rotationFile(): []byte("[]"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Fingerprint(cert)
+}
+
+func TestInterruptedCertWrite(t *testing.T) {
+	peer := newTestPeer(t, "peer")
+	original, err := peer.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := peer.certFiles()
+
+	reload := func() string {
+		t.Helper()
+		cert, err := (&Tofu{ID: peer.ID, CertPath: peer.CertPath}).cert()
+		if err != nil {
+			t.Fatalf("expected the identity to load, got: %v", err)
+		}
+		return Fingerprint(cert.Leaf)
+	}
+
+	// Crashed before committing, the old pair stays
+	rotateStaged(t, peer)
+	if err := os.Remove(peer.journalFile()); err != nil {
+		t.Fatal(err)
+	}
+	if reload() != Fingerprint(original) {
+		t.Error("expected an uncommitted write to leave the old pair")
+	}
+
+	// Crashed with only the key moved, loading finishes the write
+	rotated := rotateStaged(t, peer)
+	if err := os.Rename(keyFile+".new", keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if reload() != rotated {
+		t.Error("expected a committed write to be finished on load")
+	}
+
+	for _, path := range []string{certFile + ".new", peer.rotationFile() + ".new", peer.journalFile()} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be gone", filepath.Base(path))
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package tofu
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// TrustDBVersion is the trust database format we write, newer ones are refused
+	TrustDBVersion = 1
+
+	// FlagVerified marks peers whose fingerprint was checked out of band
+	FlagVerified = "verified"
+)
+
+// Entry is what we know about a trusted peer.
+type Entry struct {
+	ID          string    `json:"id"`
+	Algorithm   string    `json:"algorithm,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	Name        string    `json:"name,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	LastAddr    string    `json:"last_addr,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	Flags       []string  `json:"flags,omitempty"`
+
+	Rotations   []KeyRotation `json:"rotations,omitempty"`
+	Permissions *Permissions  `json:"permissions,omitempty"`
+}
+
+// KeyRotation records a peer moving to a new key with a signed rotation.
+type KeyRotation struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// Pins reports whether the entry is pinned to the key with fingerprint
+func (e *Entry) Pins(fingerprint string) bool {
+	return sameFingerprint(e.Fingerprint, fingerprint)
+}
+
+func (e *Entry) HasFlag(flag string) bool {
+	return slices.Contains(e.Flags, flag)
+}
+
+func (e *Entry) setFlag(flag string, on bool) {
+	if on == e.HasFlag(flag) {
+		return
+	}
+
+	if on {
+		e.Flags = append(e.Flags, flag)
+		sort.Strings(e.Flags)
+		return
+	}
+
+	e.Flags = slices.DeleteFunc(e.Flags, func(f string) bool {
+		return f == flag
+	})
+}
+
+// trustDB is the on disk format of TrustPath
+type trustDB struct {
+	Version int      `json:"version"`
+	Peers   []*Entry `json:"peers"`
+	Blocked []*Block `json:"blocked,omitempty"`
+}
+
+// store is the trust database in memory
+type store struct {
+	peers   map[string]*Entry
+	blocked []*Block
+}
+
+// validPeerID only refuses IDs that can't be shown or typed back, IDs are
+// never used as paths
+func validPeerID(peerID string) error {
+	if peerID == "" || strings.IndexFunc(peerID, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: %q", ErrorInvalidPeerID, peerID)
+	}
+	return nil
+}
+
+// load reads the whole database, a missing one is empty. Caller holds mu.
+func (t *Tofu) load() (*store, error) {
+	s := &store{peers: make(map[string]*Entry)}
+
+	data, err := os.ReadFile(t.TrustPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var db trustDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("failed to read trust database: %w", err)
+	}
+
+	if db.Version > TrustDBVersion {
+		return nil, fmt.Errorf("%w: %d", ErrorTrustDBVersion, db.Version)
+	}
+
+	for _, entry := range db.Peers {
+		s.peers[entry.ID] = entry
+	}
+	s.blocked = db.Blocked
+
+	return s, nil
+}
+
+// save rewrites the whole database atomically. Caller holds mu.
+func (t *Tofu) save(s *store) error {
+	db := trustDB{
+		Version: TrustDBVersion,
+		Peers:   sortedEntries(s.peers),
+		Blocked: s.blocked,
+	}
+
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	t.blocksFrom = nil
+	return WriteFileAtomic(t.TrustPath, data, 0600)
+}
+
+// update applies fn to the trusted peers and saves them if fn succeeds
+func (t *Tofu) update(fn func(peers map[string]*Entry) error) error {
+	return t.updateStore(func(s *store) error {
+		return fn(s.peers)
+	})
+}
+
+// updateStore is update for the whole database, blocklist included
+func (t *Tofu) updateStore(fn func(s *store) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.load()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(s); err != nil {
+		return err
+	}
+
+	return t.save(s)
+}
+
+// readEntry returns a copy of a peer's entry, or nil if it isn't trusted
+func (t *Tofu) readEntry(peerID string) (*Entry, error) {
+	if err := validPeerID(peerID); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := s.peers[peerID]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *entry
+	copied.Flags = slices.Clone(entry.Flags)
+	copied.Rotations = slices.Clone(entry.Rotations)
+	return &copied, nil
+}
+
+// modify applies fn to a trusted peer's entry
+func (t *Tofu) modify(peerID string, fn func(entry *Entry)) error {
+	if err := validPeerID(peerID); err != nil {
+		return err
+	}
+
+	return t.update(func(peers map[string]*Entry) error {
+		entry, ok := peers[peerID]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrorPeerNotTrusted, peerID)
+		}
+
+		fn(entry)
+		return nil
+	})
+}
+
+// seen records that a trusted peer connected, with the key it used and from where
+func (t *Tofu) seen(peerID string, cert *x509.Certificate, addr string) error {
+	return t.modify(peerID, func(entry *Entry) {
+		entry.LastSeen = time.Now()
+		entry.Algorithm = KeyAlgorithm(cert)
+
+		// Pins from before fingerprints named the algorithm get its prefix
+		if fingerprint := Fingerprint(cert); sameFingerprint(entry.Fingerprint, fingerprint) {
+			entry.Fingerprint = fingerprint
+		}
+		if addr != "" {
+			entry.LastAddr = addr
+		}
+	})
+}
+
+// rotate re-pins a peer that presented signed rotations from its pinned key,
+// unlike trust it keeps the peer's flags
+func (t *Tofu) rotate(peerID string, steps []*Rotation) error {
+	return t.modify(peerID, func(entry *Entry) {
+		for _, r := range steps {
+			entry.Rotations = append(entry.Rotations, KeyRotation{
+				From: r.From(),
+				To:   r.New,
+				At:   r.Time,
+			})
+			entry.Fingerprint = r.New
+		}
+		entry.Algorithm = ""
+	})
+}
+
+func sortedEntries(peers map[string]*Entry) []*Entry {
+	entries := make([]*Entry, 0, len(peers))
+	for _, entry := range peers {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries
+}
+
+// Entries lists every trusted peer sorted by ID.
+func (t *Tofu) Entries() ([]*Entry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedEntries(s.peers), nil
+}
+
+// Entry returns a trusted peer, or ErrorPeerNotTrusted.
+func (t *Tofu) Entry(peerID string) (*Entry, error) {
+	entry, err := t.readEntry(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%w: %s", ErrorPeerNotTrusted, peerID)
+	}
+	return entry, nil
+}
+
+// Add pins a peer out of band, before it ever connects.
+func (t *Tofu) Add(peerID, fingerprint string) error {
+	blocks, err := t.Blocks()
+	if err != nil {
+		return err
+	}
+	if err := admissible(blocks, peerID, fingerprint); err != nil {
+		return err
+	}
+
+	entry, err := t.readEntry(peerID)
+	if err != nil {
+		return err
+	}
+
+	if entry != nil && entry.Fingerprint != legacyFingerprint {
+		if sameFingerprint(entry.Fingerprint, fingerprint) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s, use replace to re-pin it", ErrorPeerAlreadyTrusted, peerID)
+	}
+
+	if err := t.trust(peerID, fingerprint); err != nil {
+		return err
+	}
+
+	return t.SetFlag(peerID, FlagVerified, true)
+}
+
+// admissible checks a pin made out of band, by Add or Import
+func admissible(blocks []*Block, peerID, fingerprint string) error {
+	if err := validPeerID(peerID); err != nil {
+		return err
+	}
+	if err := validFingerprint(fingerprint); err != nil {
+		return err
+	}
+	if blocked(blocks, peerID, fingerprint) {
+		return fmt.Errorf("%w: %s, unblock it first", ErrorPeerBlocked, peerID)
+	}
+	return nil
+}
+
+func (t *Tofu) Remove(peerID string) error {
+	if err := validPeerID(peerID); err != nil {
+		return err
+	}
+
+	return t.update(func(peers map[string]*Entry) error {
+		if _, ok := peers[peerID]; !ok {
+			return fmt.Errorf("%w: %s", ErrorPeerNotTrusted, peerID)
+		}
+
+		delete(peers, peerID)
+		return nil
+	})
+}
+
+// Rename sets the display name of a trusted peer, the ID stays what the
+// peer's certificate says.
+func (t *Tofu) Rename(peerID, name string) error {
+	return t.modify(peerID, func(entry *Entry) {
+		entry.Name = name
+	})
+}
+
+// SetNote attaches a free form note to a trusted peer.
+func (t *Tofu) SetNote(peerID, note string) error {
+	return t.modify(peerID, func(entry *Entry) {
+		entry.Note = note
+	})
+}
+
+// SetFlag sets or clears one of a trusted peer's flags.
+func (t *Tofu) SetFlag(peerID, flag string, on bool) error {
+	return t.modify(peerID, func(entry *Entry) {
+		entry.setFlag(flag, on)
+	})
+}
+
+// Export writes every trusted peer as JSON, see Import.
+func (t *Tofu) Export(w io.Writer) error {
+	entries, err := t.Entries()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// Import adds the peers written by Export and returns how many were new.
+// Nothing is written if any of them is blocked, invalid, listed twice or
+// conflicts with an existing pin.
+func (t *Tofu) Import(r io.Reader) (int, error) {
+	var entries []*Entry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, fmt.Errorf("failed to read trusted peers: %w", err)
+	}
+
+	added := 0
+	err := t.updateStore(func(s *store) error {
+		peers := s.peers
+		listed := map[string]bool{}
+
+		var fresh []*Entry
+		for _, entry := range entries {
+			if err := admissible(s.blocked, entry.ID, entry.Fingerprint); err != nil {
+				return err
+			}
+			if entry.Permissions != nil {
+				if err := entry.Permissions.validate(); err != nil {
+					return fmt.Errorf("%s: %w", entry.ID, err)
+				}
+			}
+
+			if listed[entry.ID] {
+				return fmt.Errorf("%w: %s", ErrorDuplicatePeer, entry.ID)
+			}
+			listed[entry.ID] = true
+
+			existing, ok := peers[entry.ID]
+			if ok && existing.Fingerprint != legacyFingerprint {
+				if !sameFingerprint(existing.Fingerprint, entry.Fingerprint) {
+					return &KeyChangedError{
+						PeerID:    entry.ID,
+						Known:     existing.Fingerprint,
+						Presented: entry.Fingerprint,
+					}
+				}
+				continue
+			}
+
+			fresh = append(fresh, entry)
+		}
+
+		for _, entry := range fresh {
+			if entry.FirstSeen.IsZero() {
+				entry.FirstSeen = time.Now()
+			}
+			peers[entry.ID] = entry
+		}
+
+		added = len(fresh)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return added, nil
+}
+
+// migrate imports the directory of per peer files older versions kept, each
+// named after the peer and holding either an entry or a bare fingerprint.
+// It only runs while there is no database yet, dir is left as it was.
+func (t *Tofu) migrate(dir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := os.Stat(t.TrustPath); !os.IsNotExist(err) {
+		return err
+	}
+
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	peers := make(map[string]*Entry)
+	for _, file := range files {
+		if !file.Type().IsRegular() || validPeerID(file.Name()) != nil {
+			continue
+		}
+
+		entry, err := readLegacyEntry(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+
+		entry.ID = file.Name()
+		peers[entry.ID] = entry
+	}
+
+	if len(peers) == 0 {
+		return nil
+	}
+
+	return t.save(&store{peers: peers})
+}
+
+func readLegacyEntry(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err == nil {
+		return &entry, nil
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		Fingerprint: strings.TrimSpace(string(data)),
+		FirstSeen:   stat.ModTime(),
+		LastSeen:    stat.ModTime(),
+	}, nil
+}
+
+// WriteFileAtomic replaces path with data, readers see the old file or the
+// new one and never a partial write.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
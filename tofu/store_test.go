@@ -0,0 +1,283 @@
+package tofu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreManagement(t *testing.T) {
+	tofu := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+
+	alice := Fingerprint(createTestCert(t, "alice"))
+	bob := Fingerprint(createTestCert(t, "bob"))
+
+	if err := tofu.Add("alice", alice); err != nil {
+		t.Fatalf("failed to add peer: %v", err)
+	}
+	if err := tofu.Add("bob", bob); err != nil {
+		t.Fatalf("failed to add peer: %v", err)
+	}
+
+	if err := tofu.Add("alice", alice); err != nil {
+		t.Errorf("expected adding the same pin twice to be a no-op, got: %v", err)
+	}
+	if err := tofu.Add("alice", bob); !errors.Is(err, ErrorPeerAlreadyTrusted) {
+		t.Errorf("expected ErrorPeerAlreadyTrusted, got: %v", err)
+	}
+
+	if err := tofu.Rename("alice", "Alice's laptop"); err != nil {
+		t.Fatalf("failed to rename peer: %v", err)
+	}
+
+	entry, err := tofu.Entry("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "Alice's laptop" || entry.Fingerprint != alice {
+		t.Errorf("unexpected entry after rename: %+v", entry)
+	}
+
+	entries, err := tofu.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != "alice" || entries[1].ID != "bob" {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+
+	if err := tofu.Remove("bob"); err != nil {
+		t.Fatalf("failed to remove peer: %v", err)
+	}
+	if _, err := tofu.Entry("bob"); !errors.Is(err, ErrorPeerNotTrusted) {
+		t.Errorf("expected ErrorPeerNotTrusted after remove, got: %v", err)
+	}
+	if err := tofu.Remove("bob"); !errors.Is(err, ErrorPeerNotTrusted) {
+		t.Errorf("expected ErrorPeerNotTrusted removing twice, got: %v", err)
+	}
+}
+
+func TestStoreTreatsIDsAsData(t *testing.T) {
+	tmp := t.TempDir()
+	tofu := &Tofu{TrustPath: filepath.Join(tmp, "db", "trust.json")}
+	fingerprint := Fingerprint(createTestCert(t, "peer"))
+
+	for _, id := range []string{"..", "../evil", "a/b", `a\b`} {
+		if err := tofu.Add(id, fingerprint); err != nil {
+			t.Errorf("expected %q to be stored like any other ID, got: %v", id, err)
+		}
+	}
+
+	files, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "db" {
+		t.Errorf("expected only the database directory, got: %v", files)
+	}
+
+	for _, id := range []string{"", "a\nb", "\x1b[2J"} {
+		if err := tofu.Add(id, fingerprint); !errors.Is(err, ErrorInvalidPeerID) {
+			t.Errorf("expected ErrorInvalidPeerID for %q, got: %v", id, err)
+		}
+	}
+}
+
+func TestMigrateLegacyStore(t *testing.T) {
+	tmp := t.TempDir()
+	legacy := filepath.Join(tmp, "trust")
+	if err := os.Mkdir(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	bare := Fingerprint(createTestCert(t, "bare"))
+	if err := os.WriteFile(filepath.Join(legacy, "bare"), []byte(bare), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	named := Fingerprint(createTestCert(t, "named"))
+	data, err := json.Marshal(&Entry{Fingerprint: named, Name: "Named"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacy, "named"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tofu := &Tofu{TrustPath: filepath.Join(tmp, "trust.json")}
+	if err := tofu.migrate(legacy); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	entry, err := tofu.Entry("bare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Fingerprint != bare || entry.FirstSeen.IsZero() {
+		t.Errorf("unexpected migrated entry: %+v", entry)
+	}
+
+	entry, err = tofu.Entry("named")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Fingerprint != named || entry.Name != "Named" {
+		t.Errorf("unexpected migrated entry: %+v", entry)
+	}
+
+	// Once the database exists the old files are ignored
+	if err := tofu.Remove("bare"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tofu.migrate(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tofu.Entry("bare"); !errors.Is(err, ErrorPeerNotTrusted) {
+		t.Errorf("expected migration to run only once, got: %v", err)
+	}
+}
+
+func TestStoreVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trust.json")
+	if err := os.WriteFile(path, []byte(`{"version": 99, "peers": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tofu := &Tofu{TrustPath: path}
+	if _, err := tofu.Entries(); !errors.Is(err, ErrorTrustDBVersion) {
+		t.Errorf("expected ErrorTrustDBVersion, got: %v", err)
+	}
+}
+
+func TestNotesAndFlags(t *testing.T) {
+	tofu := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	fingerprint := Fingerprint(createTestCert(t, "peer"))
+
+	if err := tofu.SetNote("peer", "desk"); !errors.Is(err, ErrorPeerNotTrusted) {
+		t.Errorf("expected ErrorPeerNotTrusted for an unknown peer, got: %v", err)
+	}
+
+	if err := tofu.Add("peer", fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if err := tofu.SetNote("peer", "desk in room 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := tofu.Entry("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Note != "desk in room 2" || !entry.HasFlag(FlagVerified) {
+		t.Errorf("expected note and verified flag, got: %+v", entry)
+	}
+
+	if err := tofu.SetFlag("peer", FlagVerified, false); err != nil {
+		t.Fatal(err)
+	}
+	entry, err = tofu.Entry("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.HasFlag(FlagVerified) {
+		t.Errorf("expected flag to be cleared, got: %+v", entry)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	dst := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+
+	alice := Fingerprint(createTestCert(t, "alice"))
+	if err := src.Add("alice", alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Rename("alice", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	exported := buf.Bytes()
+
+	n, err := dst.Import(bytes.NewReader(exported))
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 imported peer, got %d, %v", n, err)
+	}
+
+	entry, err := dst.Entry("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Fingerprint != alice || entry.Name != "Alice" {
+		t.Errorf("unexpected imported entry: %+v", entry)
+	}
+
+	n, err = dst.Import(bytes.NewReader(exported))
+	if err != nil || n != 0 {
+		t.Errorf("expected re-import to add nothing, got %d, %v", n, err)
+	}
+
+	conflicting := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	if err := conflicting.Add("alice", Fingerprint(createTestCert(t, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conflicting.Import(bytes.NewReader(exported)); !errors.Is(err, ErrorPeerKeyChanged) {
+		t.Errorf("expected conflicting import to fail with ErrorPeerKeyChanged, got: %v", err)
+	}
+}
+
+func TestImportValidates(t *testing.T) {
+	alice := Fingerprint(createTestCert(t, "alice"))
+	bob := Fingerprint(createTestCert(t, "bob"))
+	carol := Fingerprint(createTestCert(t, "carol"))
+
+	tests := []struct {
+		name    string
+		entries []*Entry
+		wantErr error
+	}{
+		{
+			name:    "blocked fingerprint",
+			entries: []*Entry{{ID: "mallory", Fingerprint: bob}},
+			wantErr: ErrorPeerBlocked,
+		},
+		{
+			name:    "invalid permissions",
+			entries: []*Entry{{ID: "alice", Fingerprint: alice, Permissions: &Permissions{Subdir: "../.."}}},
+			wantErr: ErrorInvalidPermissions,
+		},
+		{
+			name:    "listed twice",
+			entries: []*Entry{{ID: "alice", Fingerprint: alice}, {ID: "alice", Fingerprint: carol}},
+			wantErr: ErrorDuplicatePeer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tofu := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+			if err := tofu.Block(bob, "spam"); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := json.Marshal(tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := tofu.Import(bytes.NewReader(data)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got: %v", tt.wantErr, err)
+			}
+
+			if entries, err := tofu.Entries(); err != nil || len(entries) != 0 {
+				t.Errorf("expected nothing to be imported, got %+v, %v", entries, err)
+			}
+		})
+	}
+}
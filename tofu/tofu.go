@@ -2,28 +2,77 @@ package tofu
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
 	ConnectionHandler func(net.Listener) error
-	NewPeerHandler    func(string, string) bool
+	// NewPeerHandler is called with the peer ID, its fingerprint and the
+	// pairing code, it should only return true if the peer shows the same code
+	NewPeerHandler func(string, string, string) bool
+	// ShowCodeHandler is called with the peer ID and the pairing code when the
+	// peer has to confirm us but we already trust it
+	ShowCodeHandler func(string, string)
+	// KeyChangedHandler is called with the peer ID, the pinned and the presented
+	// fingerprint, the connection is refused either way
+	KeyChangedHandler func(string, string, string)
 )
 
-var UnsafeNewPeerHandler = func(peerID, fingerprint string) bool {
+// DialTimeout bounds connecting to a peer and the TLS handshake, pairing has
+// its own PairTimeout
+var DialTimeout = time.Second * 10
+
+var UnsafeNewPeerHandler = func(peerID, fingerprint, code string) bool {
 	return true
 }
 
 type Tofu struct {
-	ID           string
+	ID string
+	// Dir holds our certificate and the trust database, DefaultDir if empty
+	Dir          string
 	CertPath     string
 	TrustPath    string
 	Certificate  *tls.Certificate
 	ServerConfig *tls.Config
 	ClientConfig *tls.Config
 	OnNewPeer    NewPeerHandler
+	OnKeyChanged KeyChangedHandler
+	OnShowCode   ShowCodeHandler
+
+	// Policy decides whether peers signed by CAs are trusted without
+	// pairing, see Policy. The zero value is PolicyTOFU.
+	Policy Policy
+	CAs    *x509.CertPool
+	// CRLs revoke certificates CAs issued, see LoadCRL
+	CRLs []*x509.RevocationList
+
+	// Algorithm is the key type of identities we create, see AlgorithmEd25519.
+	// Existing keys keep theirs until rotated.
+	Algorithm string
+
+	// Passphrase unlocks our private key if it is encrypted, see SetPassphrase
+	Passphrase PassphraseFunc
+	passphrase []byte
+
+	// Code is a one-time pairing code, see NewCode. While set peers are
+	// paired with it instead of prompting, and only peers that know it can
+	// connect.
+	Code       string
+	codeBurned atomic.Bool
+
+	// guards TrustPath, the trust database
+	mu sync.Mutex
+	// blocks is the blocklist as of blocksFrom, the trust database it was
+	// read from, see IsBlocked
+	blocks     []*Block
+	blocksFrom os.FileInfo
 }
 
 func New(id string) *Tofu {
@@ -31,34 +80,128 @@ func New(id string) *Tofu {
 }
 
 func (t *Tofu) Init() error {
-	homeDir, err := os.UserHomeDir()
+	err := t.InitTrust()
 	if err != nil {
 		return err
 	}
 
-	certPath := filepath.Join(homeDir, "gobyte", "cert")
+	dir, err := t.dir()
+	if err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(dir, "cert")
 	if err := os.MkdirAll(certPath, 0700); err != nil {
 		return err
 	}
 
 	t.CertPath = certPath
 
-	trustPath := filepath.Join(homeDir, "gobyte", "trust")
-	if err := os.MkdirAll(trustPath, 0700); err != nil {
+	cert, err := t.cert()
+	if err != nil {
 		return err
 	}
+	t.Certificate = cert
 
-	t.TrustPath = trustPath
+	return nil
+}
 
-	cert, err := t.cert()
+// InitTrust prepares the trust database only, for managing trusted peers
+// without loading or creating our own certificate.
+func (t *Tofu) InitTrust() error {
+	dir, err := t.dir()
 	if err != nil {
 		return err
 	}
-	t.Certificate = cert
+
+	if t.Dir == "" && t.CertPath == "" {
+		if err := MigrateLegacyDir(dir, legacyFiles...); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	t.TrustPath = filepath.Join(dir, "trust.json")
+
+	return t.migrate(filepath.Join(dir, "trust"))
+}
+
+// DefaultDir is where Init keeps our certificate and trust database unless Dir
+// says otherwise, gobyte in the user's config directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gobyte"), nil
+}
+
+// legacyFiles are what ~/gobyte held for us before DefaultDir
+var legacyFiles = []string{"cert", "trust.json", "trust"}
+
+// MigrateLegacyDir moves names out of ~/gobyte, where everything was kept
+// before DefaultDir, into dir if dir doesn't exist yet. They are gathered in
+// a temporary directory that is renamed to dir last, a failed move puts back
+// what was moved so the next call tries again.
+func MigrateLegacyDir(dir string, names ...string) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return err
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	legacy := filepath.Join(home, "gobyte")
+
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(dir)+"-*")
+	if err != nil {
+		return err
+	}
+
+	var moved []string
+	undo := func() {
+		for _, name := range moved {
+			os.Rename(filepath.Join(tmp, name), filepath.Join(legacy, name))
+		}
+		os.RemoveAll(tmp)
+	}
+
+	for _, name := range names {
+		err := os.Rename(filepath.Join(legacy, name), filepath.Join(tmp, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			undo()
+			return fmt.Errorf("failed to move %s into %s: %w", filepath.Join(legacy, name), dir, err)
+		}
+		moved = append(moved, name)
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		undo()
+		return err
+	}
 
 	return nil
 }
 
+func (t *Tofu) dir() (string, error) {
+	if t.Dir != "" {
+		return t.Dir, nil
+	}
+	return DefaultDir()
+}
+
 func (t *Tofu) Listen(address string) (net.Listener, error) {
 	// Start will use the UnsafeNewPeerHandler if not set
 	if t.OnNewPeer == nil {
@@ -69,23 +212,35 @@ func (t *Tofu) Listen(address string) (net.Listener, error) {
 		t.ServerConfig = t.DefaultServerConfig()
 	}
 
-	listener, err := tls.Listen("tcp", address, t.ServerConfig)
+	ln, err := tls.Listen("tcp", address, t.ServerConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return listener, err
+	return &listener{Listener: ln, t: t}, nil
 }
 
-func (t *Tofu) Dial(address string) (*tls.Conn, error) {
-	if t.ClientConfig == nil {
-		t.ClientConfig = t.DefaultClientConfig()
+// Dial connects to address, an unknown peer is paired on first use, see Conn.
+func (t *Tofu) Dial(address string) (*Conn, error) {
+	if t.OnNewPeer == nil {
+		t.OnNewPeer = UnsafeNewPeerHandler
+	}
+
+	config := t.ClientConfig
+	if config == nil {
+		config = t.DefaultClientConfig()
+		config.VerifyConnection = t.verifier(address)
 	}
 
-	conn, err := tls.Dial("tcp", address, t.ClientConfig)
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
 	if err != nil {
 		return nil, err
 	}
 
-	return conn, nil
+	c := t.NewConn(conn)
+	c.addr = address
+	c.client = true
+
+	return c, nil
 }
@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"math/big"
 	"os"
 	"path/filepath"
@@ -79,17 +80,63 @@ func TestLoadOrGenerateCert(t *testing.T) {
 	}
 }
 
+func TestRenewExpiringCert(t *testing.T) {
+	tofu := &Tofu{
+		CertPath: t.TempDir(),
+		ID:       "node",
+	}
+
+	// Issue a certificate that is about to expire
+	CertValidity = time.Hour
+	cert, err := tofu.cert()
+	CertValidity = 365 * 24 * time.Hour
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, keyFile := tofu.certFiles()
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := tofu.cert()
+	if err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+
+	if Fingerprint(renewed.Leaf) != Fingerprint(cert.Leaf) {
+		t.Error("expected the renewed certificate to keep the key and fingerprint")
+	}
+	if time.Until(renewed.Leaf.NotAfter) < RenewBefore {
+		t.Errorf("expected the renewed certificate to be valid for longer, until %v", renewed.Leaf.NotAfter)
+	}
+
+	after, err := os.ReadFile(keyFile)
+	if err != nil || string(after) != string(keyPEM) {
+		t.Errorf("expected the key file to be left alone, %v", err)
+	}
+
+	// The renewed certificate is what gets loaded from now on
+	loaded, err := tofu.cert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Leaf.SerialNumber.Cmp(renewed.Leaf.SerialNumber) != 0 {
+		t.Error("expected a valid certificate not to be renewed again")
+	}
+}
+
 func TestSaveAndCheckPeerFingerprint(t *testing.T) {
-	tmpDir := t.TempDir()
 	tofu := &Tofu{
-		TrustPath: tmpDir,
+		TrustPath: filepath.Join(t.TempDir(), "trust.json"),
 	}
 
 	peerID := "peer123"
-	cert := []byte("dummy certificate data")
-	otherCert := []byte("different cert data")
+	fingerprint := Fingerprint(createTestCert(t, peerID))
+	otherFingerprint := Fingerprint(createTestCert(t, peerID))
 
-	ok, err := tofu.known(peerID, cert)
+	ok, err := tofu.known(peerID, fingerprint)
 	if err != nil {
 		t.Fatalf("unexpected error checking nonexistent fingerprint: %v", err)
 	}
@@ -97,11 +144,11 @@ func TestSaveAndCheckPeerFingerprint(t *testing.T) {
 		t.Error("expected fingerprint check to fail for non-existent fingerprint")
 	}
 
-	if err = tofu.trust(peerID, cert); err != nil {
+	if err = tofu.trust(peerID, fingerprint); err != nil {
 		t.Fatalf("failed to save fingerprint: %v", err)
 	}
 
-	ok, err = tofu.known(peerID, cert)
+	ok, err = tofu.known(peerID, fingerprint)
 	if err != nil {
 		t.Fatalf("unexpected error during fingerprint check: %v", err)
 	}
@@ -109,7 +156,7 @@ func TestSaveAndCheckPeerFingerprint(t *testing.T) {
 		t.Error("expected fingerprint check to pass for matching fingerprint")
 	}
 
-	ok, err = tofu.known(peerID, otherCert)
+	ok, err = tofu.known(peerID, otherFingerprint)
 	if err != nil {
 		t.Fatalf("unexpected error during fingerprint check: %v", err)
 	}
@@ -117,16 +164,74 @@ func TestSaveAndCheckPeerFingerprint(t *testing.T) {
 		t.Error("expected fingerprint check to fail for mismatched fingerprint")
 	}
 
-	sum := sha256.Sum256(cert)
-	expected := []byte(tofu.format("sha256", sum[:]))
-	path := filepath.Join(tmpDir, peerID)
-	data, err := os.ReadFile(path)
+	entry, err := tofu.Entry(peerID)
 	if err != nil {
-		t.Fatalf("failed to read fingerprint file: %v", err)
+		t.Fatalf("failed to read trusted peer: %v", err)
 	}
-	if string(data) != string(expected[:]) {
+	if entry.Fingerprint != fingerprint {
 		t.Error("stored fingerprint does not match expected value")
 	}
+	if entry.FirstSeen.IsZero() || entry.LastSeen.IsZero() {
+		t.Error("expected first and last seen to be recorded")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert := createTestCert(t, "peer")
+	other := createTestCert(t, "peer")
+
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	if got, want := Fingerprint(cert), "ecdsa-p256:"+format("sha256", sum[:]); got != want {
+		t.Errorf("unexpected fingerprint: got %s, want %s", got, want)
+	}
+
+	if Fingerprint(cert) == Fingerprint(other) {
+		t.Error("expected different keys to have different fingerprints")
+	}
+
+	if Fingerprint(cert) == legacyFingerprint {
+		t.Error("expected fingerprint to differ from the legacy empty fingerprint")
+	}
+}
+
+func TestLegacyPinIsReconfirmed(t *testing.T) {
+	tmp := t.TempDir()
+	peerID := "legacy-peer"
+
+	// What every trust file looked like before fingerprints hashed the public key
+	legacy := filepath.Join(tmp, "trust")
+	if err := os.Mkdir(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(nil)
+	if err := os.WriteFile(filepath.Join(legacy, peerID), []byte(format("sha256", sum[:])), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tofu := &Tofu{TrustPath: filepath.Join(tmp, "trust.json")}
+	if err := tofu.migrate(legacy); err != nil {
+		t.Fatalf("failed to migrate legacy trust files: %v", err)
+	}
+
+	cert := createTestCert(t, peerID)
+	if err := tofu.verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, ""); err != nil {
+		t.Fatalf("expected legacy pin to be left to pairing, got: %v", err)
+	}
+
+	// Pairing confirms peers that aren't pinned to the key they presented
+	pinned, err := tofu.pinned(peerID)
+	if err != nil || pinned != "" {
+		t.Errorf("expected legacy pin to count as unpinned, got %q, %v", pinned, err)
+	}
+
+	if err := tofu.trust(peerID, Fingerprint(cert)); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := tofu.known(peerID, Fingerprint(cert))
+	if err != nil || !ok {
+		t.Errorf("expected legacy pin to be replaced with the real fingerprint, got %v, %v", ok, err)
+	}
 }
 
 func createTestCert(t *testing.T, commonName string) *x509.Certificate {
@@ -161,53 +266,176 @@ func createTestCert(t *testing.T, commonName string) *x509.Certificate {
 }
 
 func TestVerifyPeer(t *testing.T) {
-	tmp := t.TempDir()
-
 	peerID := "peerABC"
 	tofu := &Tofu{
-		TrustPath: tmp,
-		OnNewPeer: func(id, fingerprint string) bool {
-			return id == peerID
-		},
+		TrustPath: filepath.Join(t.TempDir(), "trust.json"),
 	}
 
 	t.Run("no cert provided", func(t *testing.T) {
-		err := tofu.verify(tls.ConnectionState{})
+		err := tofu.verify(tls.ConnectionState{}, "")
 		if err != ErrorNoCertificateProvided {
 			t.Errorf("expected ErrorNoCertificateProvided, got: %v", err)
 		}
 	})
 
-	t.Run("unknown cert, trusted by OnNewPeer", func(t *testing.T) {
+	t.Run("unknown cert is left to pairing", func(t *testing.T) {
 		cert := createTestCert(t, peerID)
 
 		state := tls.ConnectionState{
 			PeerCertificates: []*x509.Certificate{cert},
 		}
 
-		err := tofu.verify(state)
+		err := tofu.verify(state, "")
 		if err != nil {
 			t.Fatalf("expected no error, got: %v", err)
 		}
 
-		err = tofu.verify(state)
+		if pinned, err := tofu.pinned(peerID); err != nil || pinned != "" {
+			t.Fatalf("expected verify not to pin an unknown peer, got %q, %v", pinned, err)
+		}
+
+		if err := tofu.trust(peerID, Fingerprint(cert)); err != nil {
+			t.Fatal(err)
+		}
+
+		err = tofu.verify(state, "192.168.1.20:8080")
 		if err != nil {
 			t.Fatalf("expected known cert to be accepted, got: %v", err)
 		}
+
+		entry, err := tofu.Entry(peerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Algorithm != "ecdsa-p256" || entry.LastAddr != "192.168.1.20:8080" {
+			t.Errorf("expected key algorithm and last address to be recorded, got: %+v", entry)
+		}
 	})
 
-	t.Run("unknown cert, rejected by OnNewPeer", func(t *testing.T) {
-		tofu.OnNewPeer = func(peerID string, fingerprint string) bool {
-			return false
+	t.Run("swapped key for known peer", func(t *testing.T) {
+		var warned []string
+		tofu.OnKeyChanged = func(id, known, presented string) {
+			warned = []string{id, known, presented}
+		}
+
+		pinned, err := tofu.pinned(peerID)
+		if err != nil {
+			t.Fatal(err)
 		}
-		cert := createTestCert(t, "rejected-peer")
+
+		swapped := createTestCert(t, peerID)
 		state := tls.ConnectionState{
-			PeerCertificates: []*x509.Certificate{cert},
+			PeerCertificates: []*x509.Certificate{swapped},
+		}
+
+		err = tofu.verify(state, "")
+		if !errors.Is(err, ErrorPeerKeyChanged) {
+			t.Fatalf("expected ErrorPeerKeyChanged, got: %v", err)
+		}
+
+		var changed *KeyChangedError
+		if !errors.As(err, &changed) || changed.Known != pinned || changed.Presented != Fingerprint(swapped) {
+			t.Errorf("expected error to carry both fingerprints, got: %v", err)
 		}
 
-		err := tofu.verify(state)
-		if err != ErrorConnectionDenied {
-			t.Errorf("expected ErrorConnectionDenied, got: %v", err)
+		if len(warned) != 3 || warned[0] != peerID || warned[1] != pinned || warned[2] != Fingerprint(swapped) {
+			t.Errorf("expected OnKeyChanged with both fingerprints, got: %v", warned)
+		}
+
+		// Refusing must not touch the pin
+		stillPinned, err := tofu.pinned(peerID)
+		if err != nil || stillPinned != pinned {
+			t.Errorf("expected pin to be unchanged, got %s, %v", stillPinned, err)
+		}
+
+		if err := tofu.Replace(peerID, Fingerprint(swapped)); err != nil {
+			t.Fatalf("failed to replace pin: %v", err)
+		}
+
+		if err := tofu.verify(state, ""); err != nil {
+			t.Errorf("expected replaced key to be accepted, got: %v", err)
 		}
 	})
+
+}
+
+func TestReplace(t *testing.T) {
+	tofu := &Tofu{TrustPath: filepath.Join(t.TempDir(), "trust.json")}
+	fingerprint := Fingerprint(createTestCert(t, "peer"))
+
+	if err := tofu.Replace("peer", fingerprint); !errors.Is(err, ErrorPeerNotTrusted) {
+		t.Errorf("expected ErrorPeerNotTrusted for an unknown peer, got: %v", err)
+	}
+
+	if err := tofu.trust("peer", fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []string{"", "sha256:zz", "md5:" + fingerprint[len("sha256:"):], "sha256:abcd"}
+	for _, fp := range invalid {
+		if err := tofu.Replace("peer", fp); !errors.Is(err, ErrorInvalidFingerprint) {
+			t.Errorf("expected ErrorInvalidFingerprint for %q, got: %v", fp, err)
+		}
+	}
+}
+
+func TestInitMigratesLegacyDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+
+	// An identity from before DefaultDir
+	old := &Tofu{ID: "node", Dir: filepath.Join(home, "gobyte")}
+	if err := old.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tofu := New("node")
+	if err := tofu.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := DefaultDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tofu.CertPath != filepath.Join(dir, "cert") {
+		t.Errorf("expected the certificate in %s, got %s", dir, tofu.CertPath)
+	}
+	if Fingerprint(leaf(t, tofu)) != Fingerprint(leaf(t, old)) {
+		t.Error("expected the legacy key to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(home, "gobyte", "cert")); !os.IsNotExist(err) {
+		t.Errorf("expected the legacy certificate to be moved, got: %v", err)
+	}
+}
+
+func TestMigrateLegacyDirKeepsExisting(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	legacy := filepath.Join(home, "gobyte")
+	if err := os.MkdirAll(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacy, "trust.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(home, "config")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateLegacyDir(dir, legacyFiles...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(legacy, "trust.json")); err != nil {
+		t.Errorf("expected an existing dir to be left alone, got: %v", err)
+	}
+
+	entries, err := os.ReadDir(home)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("expected no temporary dir left behind, got %v, %v", entries, err)
+	}
 }
@@ -1,37 +1,77 @@
 package tofu
 
 import (
-	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
+	"fmt"
 )
 
-func (t *Tofu) verify(cs tls.ConnectionState) error {
+// verifier checks connections to or from addr, which is recorded as the
+// peer's last address
+func (t *Tofu) verifier(addr string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		return t.verify(cs, addr)
+	}
+}
+
+func (t *Tofu) verify(cs tls.ConnectionState, addr string) error {
 	if len(cs.PeerCertificates) == 0 {
 		return ErrorNoCertificateProvided
 	}
 
 	cert := cs.PeerCertificates[0]
 	peerID := cert.Subject.CommonName
-	fingerprint, _ := x509.MarshalPKIXPublicKey(cert.Raw)
+	fingerprint := Fingerprint(cert)
 
-	known, err := t.known(peerID, fingerprint)
+	// Blocked peers are refused before anything else, CAs included
+	isBlocked, err := t.IsBlocked(peerID, fingerprint)
 	if err != nil {
 		return err
 	}
+	if isBlocked {
+		return fmt.Errorf("%w: %s", ErrorPeerBlocked, peerID)
+	}
 
-	sha256Fingerprint := sha256.Sum256(fingerprint)
-	prefixedFingerprint := t.format("sha256", sha256Fingerprint[:])
-
-	if !known {
-		if !t.OnNewPeer(peerID, prefixedFingerprint) {
-			return ErrorConnectionDenied
+	// The CA vouches for the peer, whatever we pinned for it
+	if t.usesCA() {
+		err := t.verifyCA(cs)
+		if err == nil {
+			return nil
 		}
-		err = t.trust(peerID, fingerprint)
-		if err != nil {
+		if t.Policy == PolicyCA {
 			return err
 		}
 	}
 
-	return nil
+	pinned, err := t.pinned(peerID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pinned == "":
+		// Unknown peers are paired once the handshake is done, the session's
+		// keying material isn't available to both sides before that
+		return nil
+	case sameFingerprint(pinned, fingerprint):
+		return t.seen(peerID, cert, addr)
+	default:
+		// A key we pinned signed off on the new one
+		if steps := followRotations(peerID, pinned, cert); steps != nil {
+			if err := t.rotate(peerID, steps); err != nil {
+				return err
+			}
+			return t.seen(peerID, cert, addr)
+		}
+
+		// Never prompt here, a changed key is either a reinstall or someone
+		// impersonating the peer and only the user can tell which
+		if t.OnKeyChanged != nil {
+			t.OnKeyChanged(peerID, pinned, fingerprint)
+		}
+		return &KeyChangedError{
+			PeerID:    peerID,
+			Known:     pinned,
+			Presented: fingerprint,
+		}
+	}
 }